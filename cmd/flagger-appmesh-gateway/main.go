@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	flag "github.com/spf13/pflag"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/discovery"
 	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/events"
 	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/server"
 	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/signals"
 )
@@ -27,9 +29,23 @@ var (
 	masterURL        string
 	kubeConfig       string
 	port             int
+	xdsCertFile      string
+	xdsKeyFile       string
+	xdsCAFile        string
+	xdsAllowedNodes  []string
+	httpPort         int
+	webhookPort      int
+	webhookCertFile  string
+	webhookKeyFile   string
 	namespace        string
 	ads              bool
 	optIn            bool
+	nodeGroup        string
+	tls              bool
+	httpsRedirect    bool
+	eds              bool
+	leaderElect      bool
+	gracePeriod      time.Duration
 	gatewayMesh      string
 	gatewayName      string
 	gatewayNamespace string
@@ -40,9 +56,23 @@ func init() {
 	pf.StringVarP(&masterURL, "master", "", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
 	pf.StringVarP(&kubeConfig, "kubeconfig", "", "", "Path to a kubeconfig. Only required if out-of-cluster.")
 	pf.IntVarP(&port, "port", "p", 18000, "Envoy xDS port to listen on.")
+	pf.StringVarP(&xdsCertFile, "xds-cert-file", "", "", "Path to the xDS server TLS certificate, when set Envoy must present a client certificate signed by the xDS CA.")
+	pf.StringVarP(&xdsKeyFile, "xds-key-file", "", "", "Path to the xDS server TLS private key.")
+	pf.StringVarP(&xdsCAFile, "xds-ca-file", "", "", "Path to the CA certificate used to verify the Envoy client certificates.")
+	pf.StringSliceVarP(&xdsAllowedNodes, "xds-allowed-nodes", "", nil, "Envoy node IDs or clusters allowed to connect to the xDS server, a blank value allows all nodes.")
+	pf.IntVarP(&httpPort, "http-port", "", 9090, "HTTP port to listen on for Prometheus metrics, health checks and the debug API.")
+	pf.IntVarP(&webhookPort, "webhook-port", "", 0, "HTTPS port to listen on for the virtual service validating admission webhook, zero disables the webhook.")
+	pf.StringVarP(&webhookCertFile, "webhook-cert-file", "", "", "Path to the admission webhook TLS certificate.")
+	pf.StringVarP(&webhookKeyFile, "webhook-key-file", "", "", "Path to the admission webhook TLS private key.")
 	pf.BoolVarP(&ads, "ads", "a", true, "ADS flag forces all Envoy resources to be explicitly named in the request.")
 	pf.StringVarP(&namespace, "namespace", "n", "", "Namespace to watch for Kubernetes objects, a blank value means all namespaces.")
 	pf.BoolVarP(&optIn, "opt-in", "", false, "When enabled only services with the 'expose' annotation will be discoverable.")
+	pf.StringVarP(&nodeGroup, "node-group", "", envoy.GroupByID, "Envoy node field used to group nodes, can be 'id', 'cluster' or 'metadata.<key>'.")
+	pf.BoolVarP(&tls, "tls", "", false, "When enabled the kubernetes.io/tls secrets are watched and used for TLS termination on port 8443.")
+	pf.BoolVarP(&httpsRedirect, "https-redirect", "", false, "When enabled the plaintext requests are redirected to HTTPS, can be overridden with the 'https-redirect' annotation.")
+	pf.BoolVarP(&eds, "eds", "", false, "When enabled the Kubernetes endpoints are watched and served over EDS instead of resolving the services with DNS.")
+	pf.BoolVarP(&leaderElect, "leader-elect", "", false, "When enabled only the replica holding the Lease in the gateway namespace writes the gateway virtual node.")
+	pf.DurationVarP(&gracePeriod, "shutdown-grace-period", "", 15*time.Second, "Time to keep serving the last snapshot after a shutdown signal, while the readiness check fails.")
 	pf.StringVarP(&gatewayMesh, "gateway-mesh", "", "", "App Mesh mesh that this gateway belongs to.")
 	cobra.MarkFlagRequired(pf, "gateway-mesh")
 	pf.StringVarP(&gatewayName, "gateway-name", "", "", "Gateway Kubernetes service name.")
@@ -83,27 +113,95 @@ func run(cmd *cobra.Command, args []string) error {
 	}
 
 	stopCh := signals.SetupSignalHandler()
-	ctx := context.Background()
-	cache := envoy.NewCache(ads)
+	ctx, cancel := context.WithCancel(context.Background())
+	ctrlStopCh := make(chan struct{})
+	hasher := envoy.Hasher{GroupBy: nodeGroup}
+	cache := envoy.NewCache(ads, hasher)
 	snapshot := envoy.NewSnapshot(cache)
 
-	klog.Infof("starting xDS server on port %d", port)
-	srv := server.NewServer(port, cache)
-	go srv.Serve(ctx)
-
-	klog.Info("waiting for Envoy to connect to the xDS server")
-	srv.Report()
-
 	vnManager := discovery.NewVirtualNodeManager(client, gatewayMesh, gatewayName, gatewayNamespace)
 	if err := vnManager.CheckAccess(); err != nil {
 		klog.Fatalf("the gateway can't read App Mesh objects, check RBAC, error %v", err)
 	}
 
-	vsManager := discovery.NewVirtualServiceManager(client, optIn)
-	kd := discovery.NewController(client, namespace, snapshot, vsManager, vnManager)
+	recorder, err := events.NewRecorder(cfg, client, gatewayName, gatewayNamespace)
+	if err != nil {
+		klog.Fatalf("error building event recorder: %v", err)
+	}
+
+	vsManager := discovery.NewVirtualServiceManager(client, optIn, httpsRedirect)
+	kd := discovery.NewController(client, namespace, snapshot, vsManager, vnManager, recorder, tls, eds)
+
+	auth, err := server.NewAuth(xdsCertFile, xdsKeyFile, xdsCAFile, xdsAllowedNodes)
+	if err != nil {
+		klog.Fatalf("error loading xDS TLS config: %v", err)
+	}
+
+	srv := server.NewServer(port, cache, snapshot, hasher, recorder, auth)
+	httpSrv := server.NewHTTPServer(httpPort, kd.Ready, snapshot, srv)
+
+	klog.Infof("starting HTTP server on port %d", httpPort)
+	httpDone := make(chan struct{})
+	go func() {
+		httpSrv.ListenAndServe(ctx)
+		close(httpDone)
+	}()
+
+	webhookDone := make(chan struct{})
+	if webhookPort > 0 {
+		if webhookCertFile == "" || webhookKeyFile == "" {
+			klog.Fatal("the admission webhook requires --webhook-cert-file and --webhook-key-file")
+		}
+		webhookSrv := server.NewWebhookServer(webhookPort, webhookCertFile, webhookKeyFile, vsManager, snapshot)
+		klog.Infof("starting admission webhook server on port %d", webhookPort)
+		go func() {
+			webhookSrv.ListenAndServeTLS(ctx)
+			close(webhookDone)
+		}()
+	} else {
+		close(webhookDone)
+	}
+
+	klog.Infof("starting xDS server on port %d", port)
+	xdsDone := make(chan struct{})
+	go func() {
+		srv.Serve(ctx)
+		close(xdsDone)
+	}()
+
+	if leaderElect {
+		identity, err := os.Hostname()
+		if err != nil {
+			klog.Fatalf("error getting hostname: %v", err)
+		}
+
+		klog.Infof("starting leader election for %s", identity)
+		if err := kd.RunLeaderElection(cfg, gatewayNamespace, gatewayName, identity, ctrlStopCh); err != nil {
+			klog.Fatalf("error starting leader election: %v", err)
+		}
+	}
 
 	klog.Info("starting App Mesh discovery workers")
-	kd.Run(2, stopCh)
+	ctrlDone := make(chan struct{})
+	go func() {
+		kd.Run(2, ctrlStopCh)
+		close(ctrlDone)
+	}()
+
+	// a second signal forces the exit
+	<-stopCh
+	klog.Infof("shutting down, serving the last snapshot for %v", gracePeriod)
+	httpSrv.Drain()
+	time.Sleep(gracePeriod)
+
+	close(ctrlStopCh)
+	<-ctrlDone
+
+	klog.Info("stopping xDS, HTTP and webhook servers")
+	cancel()
+	<-xdsDone
+	<-httpDone
+	<-webhookDone
 
 	return nil
 }
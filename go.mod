@@ -4,16 +4,18 @@ go 1.13
 
 require (
 	github.com/aws/aws-app-mesh-controller-for-k8s v0.2.0
-	github.com/envoyproxy/go-control-plane v0.9.0
+	github.com/envoyproxy/go-control-plane v0.10.3
 	github.com/gogo/protobuf v1.3.1 // indirect
-	github.com/golang/protobuf v1.3.2
 	github.com/googleapis/gnostic v0.3.1 // indirect
 	github.com/imdario/mergo v0.3.8 // indirect
 	github.com/mitchellh/hashstructure v1.0.0
+	github.com/prometheus/client_golang v1.12.2
 	github.com/spf13/cobra v0.0.5
-	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
-	google.golang.org/grpc v1.23.0
-	k8s.io/api v0.0.0-20191025225708-5524a3672fbb // indirect
+	github.com/spf13/pflag v1.0.3
+	google.golang.org/genproto v0.0.0-20220329172620-7be39ac1afc7
+	google.golang.org/grpc v1.45.0
+	google.golang.org/protobuf v1.28.0
+	k8s.io/api v0.0.0-20191025225708-5524a3672fbb
 	k8s.io/apimachinery v0.0.0-20191025225532-af6325b3a843
 	k8s.io/client-go v11.0.0+incompatible
 	k8s.io/klog v1.0.0
@@ -2,9 +2,17 @@ package discovery
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	appmeshv1 "github.com/aws/aws-app-mesh-controller-for-k8s/pkg/apis/appmesh/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -15,23 +23,42 @@ import (
 	"k8s.io/klog"
 
 	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/events"
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/metrics"
 )
 
 // Controller watches Kubernetes for App Mesh virtual services and
 // creates or deletes Envoy clusters and virtual hosts
 type Controller struct {
-	client    dynamic.Interface
-	indexer   cache.Indexer
-	queue     workqueue.RateLimitingInterface
-	informer  cache.Controller
-	snapshot  *envoy.Snapshot
-	vsManager *VirtualServiceManager
-	vnManager *VirtualNodeManager
-}
-
-// NewController reconciles the App Mesh virtual services with Envoy clusters and virtual hosts
-func NewController(client dynamic.Interface, namespace string, snapshot *envoy.Snapshot, vsManager *VirtualServiceManager, vnManager *VirtualNodeManager) *Controller {
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	client         dynamic.Interface
+	indexer        cache.Indexer
+	queue          workqueue.RateLimitingInterface
+	informer       cache.Controller
+	secretInformer cache.Controller
+	epInformer     cache.Controller
+	snapshot       *envoy.Snapshot
+	vsManager      *VirtualServiceManager
+	vnManager      *VirtualNodeManager
+	synced         int32
+	reconcileErr   error
+	lastBackends   []string
+	recorder       *events.Recorder
+	reported       map[string]string
+	conflicts      map[envoy.Conflict]bool
+	syncCh         chan struct{}
+	syncMu         sync.Mutex
+	storeMu        sync.Mutex
+	mu             sync.Mutex
+}
+
+// syncDebounce is the delay used to batch the snapshot builds triggered by events
+const syncDebounce = 500 * time.Millisecond
+
+// NewController reconciles the App Mesh virtual services with Envoy clusters and virtual hosts,
+// when TLS is enabled the kubernetes.io/tls secrets are synced with Envoy secrets,
+// when EDS is enabled the Kubernetes endpoints are synced with Envoy load assignments
+func NewController(client dynamic.Interface, namespace string, snapshot *envoy.Snapshot, vsManager *VirtualServiceManager, vnManager *VirtualNodeManager, recorder *events.Recorder, tls bool, eds bool) *Controller {
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "virtualservices")
 	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, namespace, nil)
 	gvr, _ := schema.ParseResourceArg("virtualservices.v1beta1.appmesh.k8s.aws")
 	vsFactory := factory.ForResource(*gvr)
@@ -59,7 +86,7 @@ func NewController(client dynamic.Interface, namespace string, snapshot *envoy.S
 	}
 	informer.AddEventHandler(handlers)
 
-	return &Controller{
+	ctrl := &Controller{
 		client:    client,
 		informer:  informer,
 		indexer:   indexer,
@@ -67,25 +94,163 @@ func NewController(client dynamic.Interface, namespace string, snapshot *envoy.S
 		snapshot:  snapshot,
 		vsManager: vsManager,
 		vnManager: vnManager,
+		syncCh:    make(chan struct{}, 1),
+		recorder:  recorder,
+		reported:  make(map[string]string),
+	}
+
+	if tls {
+		ctrl.secretInformer = ctrl.newSecretInformer(namespace)
+	}
+
+	if eds {
+		ctrl.epInformer = ctrl.newEndpointsInformer(namespace)
+	}
+
+	return ctrl
+}
+
+func (ctrl *Controller) newSecretInformer(namespace string) cache.Controller {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(ctrl.client, 0, namespace, func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("type", string(corev1.SecretTypeTLS)).String()
+	})
+	informer := factory.ForResource(corev1.SchemeGroupVersion.WithResource("secrets")).Informer()
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ctrl.storeCertificate(obj)
+		},
+		UpdateFunc: func(oldObj, obj interface{}) {
+			ctrl.storeCertificate(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err == nil {
+				ctrl.snapshot.DeleteCertificate(key)
+				ctrl.enqueueSecretRefs(key)
+			}
+		},
+	}
+	informer.AddEventHandler(handlers)
+	return informer
+}
+
+func (ctrl *Controller) storeCertificate(obj interface{}) {
+	un, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	cert, err := CertificateFromUnstructured(un)
+	if err != nil {
+		klog.Errorf("secret %s/%s conversion failed %v", un.GetNamespace(), un.GetName(), err)
+		return
 	}
+	ctrl.snapshot.StoreCertificate(cert.Name, *cert)
+	ctrl.enqueueSecretRefs(cert.Name)
 }
 
-// Run starts the App Mesh discovery controller
+// enqueueSecretRefs adds to the queue the virtual services that are referencing a secret
+func (ctrl *Controller) enqueueSecretRefs(secretKey string) {
+	for _, value := range ctrl.indexer.List() {
+		un := value.(*unstructured.Unstructured)
+		name, ok := un.GetAnnotations()[envoy.GatewayTLSSecret]
+		if ok && fmt.Sprintf("%s/%s", un.GetNamespace(), name) == secretKey {
+			key, err := cache.MetaNamespaceKeyFunc(un)
+			if err == nil {
+				ctrl.queue.Add(key)
+			}
+		}
+	}
+}
+
+func (ctrl *Controller) newEndpointsInformer(namespace string) cache.Controller {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(ctrl.client, 0, namespace, nil)
+	informer := factory.ForResource(corev1.SchemeGroupVersion.WithResource("endpoints")).Informer()
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ctrl.storeEndpoints(obj)
+		},
+		UpdateFunc: func(oldObj, obj interface{}) {
+			ctrl.storeEndpoints(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err == nil {
+				ctrl.snapshot.DeleteEndpoints(key)
+				ctrl.enqueueServiceRefs(key)
+			}
+		},
+	}
+	informer.AddEventHandler(handlers)
+	return informer
+}
+
+func (ctrl *Controller) storeEndpoints(obj interface{}) {
+	un, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	endpoints, err := EndpointsFromUnstructured(un)
+	if err != nil {
+		klog.Errorf("endpoints %s/%s conversion failed %v", un.GetNamespace(), un.GetName(), err)
+		return
+	}
+	key := fmt.Sprintf("%s/%s", un.GetNamespace(), un.GetName())
+	ctrl.snapshot.StoreEndpoints(key, endpoints)
+	ctrl.enqueueServiceRefs(key)
+}
+
+// enqueueServiceRefs adds to the queue the virtual services that are targeting a Kubernetes service
+func (ctrl *Controller) enqueueServiceRefs(serviceKey string) {
+	for _, value := range ctrl.indexer.List() {
+		un := value.(*unstructured.Unstructured)
+		if ServiceKey(un.GetName(), un.GetNamespace()) == serviceKey {
+			key, err := cache.MetaNamespaceKeyFunc(un)
+			if err == nil {
+				ctrl.queue.Add(key)
+			}
+		}
+	}
+}
+
+// Run starts the App Mesh discovery controller,
+// on stop the workqueue is shut down and the in-flight items are processed before returning
 func (ctrl *Controller) Run(threadiness int, stopCh <-chan struct{}) {
 	defer runtime.HandleCrash()
 	defer ctrl.queue.ShutDown()
 
 	go ctrl.informer.Run(stopCh)
+	synced := []cache.InformerSynced{ctrl.informer.HasSynced}
 
-	if !cache.WaitForCacheSync(stopCh, ctrl.informer.HasSynced) {
+	if ctrl.secretInformer != nil {
+		go ctrl.secretInformer.Run(stopCh)
+		synced = append(synced, ctrl.secretInformer.HasSynced)
+	}
+
+	if ctrl.epInformer != nil {
+		go ctrl.epInformer.Run(stopCh)
+		synced = append(synced, ctrl.epInformer.HasSynced)
+	}
+
+	if !cache.WaitForCacheSync(stopCh, synced...) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
 		return
 	}
 
+	atomic.StoreInt32(&ctrl.synced, 1)
 	ctrl.syncAll()
 
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctrl.runSync(stopCh)
+	}()
 	for i := 0; i < threadiness; i++ {
-		go wait.Until(ctrl.runWorker, time.Second, stopCh)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(ctrl.runWorker, time.Second, stopCh)
+		}()
 	}
 
 	tickChan := time.NewTicker(5 * time.Minute).C
@@ -95,13 +260,40 @@ func (ctrl *Controller) Run(threadiness int, stopCh <-chan struct{}) {
 			ctrl.syncAll()
 		case <-stopCh:
 			klog.Info("stopping Kubernetes discovery workers")
+			ctrl.queue.ShutDown()
+			wg.Wait()
 			return
 		}
 	}
 }
 
+// Ready returns an error if the informer caches haven't synced, no snapshot
+// has been built yet or the last virtual node reconciliation failed
+func (ctrl *Controller) Ready() error {
+	if atomic.LoadInt32(&ctrl.synced) == 0 {
+		return fmt.Errorf("informer caches not synced")
+	}
+
+	if !ctrl.snapshot.Synced() {
+		return fmt.Errorf("snapshot not synced")
+	}
+
+	ctrl.mu.Lock()
+	defer ctrl.mu.Unlock()
+	if ctrl.reconcileErr != nil {
+		return fmt.Errorf("virtual node reconciliation failed %v", ctrl.reconcileErr)
+	}
+	return nil
+}
+
+// sync updates the upstream of a virtual service and schedules a snapshot build
 func (ctrl *Controller) sync(key string) error {
-	_, exists, err := ctrl.indexer.GetByKey(key)
+	// the upstream is read and stored under the same lock as the full resync
+	// to avoid the resync pruning or overwriting it with an older object
+	ctrl.storeMu.Lock()
+	defer ctrl.storeMu.Unlock()
+
+	obj, exists, err := ctrl.indexer.GetByKey(key)
 	if err != nil {
 		klog.Errorf("fetching object with key %s from store failed %v", key, err)
 		return err
@@ -110,38 +302,225 @@ func (ctrl *Controller) sync(key string) error {
 	if !exists {
 		klog.Infof("deleting %s from cache", key)
 		ctrl.snapshot.Delete(key)
+		ctrl.forget(key)
+		ctrl.requestSync()
+		return nil
 	}
 
-	ctrl.syncAll()
+	un := obj.(*unstructured.Unstructured)
+	vs, err := ctrl.vsManager.VirtualServiceFromUnstructured(un)
+	if err != nil {
+		return fmt.Errorf("unmarshal object %s from store failed %v", key, err)
+	}
+	if !ctrl.storeVirtualService(key, un, vs) {
+		if _, ok := ctrl.snapshot.Load(key); ok {
+			klog.Infof("deleting %s from cache, virtual service is not eligible", key)
+			ctrl.snapshot.Delete(key)
+		}
+	}
+
+	ctrl.requestSync()
 	return nil
 }
 
+// syncAll updates the upstreams of the eligible virtual services, removes the upstreams
+// of the virtual services that were deleted or are no longer eligible,
+// reconciles the virtual node and builds the snapshot
 func (ctrl *Controller) syncAll() {
-	var backends []string
+	ctrl.storeMu.Lock()
+	desired := make(map[string]bool)
 	for _, value := range ctrl.indexer.List() {
 		un := value.(*unstructured.Unstructured)
+		key, err := cache.MetaNamespaceKeyFunc(un)
+		if err != nil {
+			continue
+		}
 		vs, err := ctrl.vsManager.VirtualServiceFromUnstructured(un)
 		if err != nil {
-			klog.Errorf("unmarshal object %s from store failed %v", un.GetName(), err)
-			return
+			// keep the current upstream until the object can be read
+			klog.Errorf("unmarshal object %s from store failed %v", key, err)
+			desired[key] = true
+			continue
 		}
-		if ctrl.vsManager.IsValid(*vs) {
-			backends = append(backends, vs.Name)
-			ctrl.snapshot.Store(fmt.Sprintf("%s/%s", vs.Namespace, vs.Name), ctrl.vsManager.ConvertToUpstream(*vs))
+		if ctrl.storeVirtualService(key, un, vs) {
+			desired[key] = true
 		}
 	}
 
-	err := ctrl.vnManager.Reconcile(backends)
-	if err != nil {
-		klog.Error(err)
+	for key := range ctrl.snapshot.Upstreams() {
+		if !desired[key] {
+			klog.Infof("deleting %s from cache", key)
+			ctrl.snapshot.Delete(key)
+		}
+	}
+	ctrl.storeMu.Unlock()
+
+	ctrl.mu.Lock()
+	for key := range ctrl.reported {
+		if _, exists, _ := ctrl.indexer.GetByKey(key); !exists {
+			delete(ctrl.reported, key)
+		}
+	}
+	ctrl.mu.Unlock()
+
+	ctrl.reconcile(true)
+}
+
+// storeVirtualService stores the upstream of an eligible virtual service
+// and reports if the virtual service is exposed or skipped,
+// it returns false if the virtual service is not eligible
+func (ctrl *Controller) storeVirtualService(key string, un *unstructured.Unstructured, vs *appmeshv1.VirtualService) bool {
+	if ok, reason := ctrl.vsManager.IsValid(*vs); !ok {
+		ctrl.report(key, un, corev1.EventTypeNormal, "Skipped", "not exposed by the gateway, %s", reason)
+		return false
+	}
+
+	upstream, errs := ctrl.vsManager.ConvertToUpstream(*vs)
+	ctrl.snapshot.Store(key, upstream)
+
+	domains := strings.Join(upstream.Domains, ",")
+	if len(errs) > 0 {
+		var messages []string
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		sort.Strings(messages)
+		ctrl.report(key, un, corev1.EventTypeWarning, "InvalidAnnotations",
+			"exposed by the gateway on %s, invalid annotations %s", domains, strings.Join(messages, ", "))
+	} else {
+		ctrl.report(key, un, corev1.EventTypeNormal, "Exposed", "exposed by the gateway on %s", domains)
+	}
+	return true
+}
+
+// report records an event for a virtual service if its status changed since the last report
+func (ctrl *Controller) report(key string, obj *unstructured.Unstructured, eventType string, reason string, messageFmt string, args ...interface{}) {
+	status := reason + " " + fmt.Sprintf(messageFmt, args...)
+	ctrl.mu.Lock()
+	if ctrl.reported[key] == status {
+		ctrl.mu.Unlock()
 		return
 	}
+	ctrl.reported[key] = status
+	ctrl.mu.Unlock()
+
+	if eventType == corev1.EventTypeWarning {
+		klog.Warningf("virtual service %s %s", key, status)
+	}
+	ctrl.recorder.Eventf(obj, eventType, reason, messageFmt, args...)
+}
+
+// forget removes the reported status of a deleted virtual service
+func (ctrl *Controller) forget(key string) {
+	ctrl.mu.Lock()
+	defer ctrl.mu.Unlock()
+	delete(ctrl.reported, key)
+}
+
+// requestSync schedules a snapshot build without blocking,
+// the requests made while a build is pending are batched together
+func (ctrl *Controller) requestSync() {
+	select {
+	case ctrl.syncCh <- struct{}{}:
+	default:
+	}
+}
 
-	err = ctrl.snapshot.Sync()
+// runSync builds the snapshot after a debounce period for the batched sync requests
+func (ctrl *Controller) runSync(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-ctrl.syncCh:
+			select {
+			case <-time.After(syncDebounce):
+			case <-stopCh:
+				return
+			}
+			// the changes requested during the debounce period are included in this build
+			select {
+			case <-ctrl.syncCh:
+			default:
+			}
+			ctrl.reconcile(false)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// reconcile updates the virtual node backends if they changed since the last
+// successful reconciliation or if forced, then builds the snapshot
+func (ctrl *Controller) reconcile(force bool) {
+	ctrl.syncMu.Lock()
+	defer ctrl.syncMu.Unlock()
+
+	backends := ctrl.backends()
+	ctrl.mu.Lock()
+	changed := force || ctrl.reconcileErr != nil || !equalBackends(ctrl.lastBackends, backends)
+	ctrl.mu.Unlock()
+
+	if changed {
+		err := ctrl.vnManager.Reconcile(backends)
+		ctrl.mu.Lock()
+		ctrl.reconcileErr = err
+		if err == nil {
+			ctrl.lastBackends = backends
+		}
+		ctrl.mu.Unlock()
+		if err != nil {
+			metrics.VirtualNodeErrors.Inc()
+			klog.Error(err)
+			return
+		}
+	}
+
+	err := ctrl.snapshot.Sync()
 	if err != nil {
 		klog.Errorf("snapshot error %v", err)
 		return
 	}
+	ctrl.reportConflicts()
+}
+
+// reportConflicts records an event for the virtual services that lost a domain to an older virtual service,
+// a conflict is reported once until it's resolved
+func (ctrl *Controller) reportConflicts() {
+	current := make(map[envoy.Conflict]bool)
+	for _, conflict := range ctrl.snapshot.Conflicts() {
+		current[conflict] = true
+		if ctrl.conflicts[conflict] {
+			continue
+		}
+		obj, exists, err := ctrl.indexer.GetByKey(conflict.Upstream)
+		if err != nil || !exists {
+			continue
+		}
+		ctrl.recorder.Eventf(obj.(*unstructured.Unstructured), corev1.EventTypeWarning, "DomainConflict",
+			"domain %s is not served, it's claimed by the older virtual service %s", conflict.Domain, conflict.Winner)
+	}
+	ctrl.conflicts = current
+}
+
+// backends returns the sorted virtual service names of the stored upstreams
+func (ctrl *Controller) backends() []string {
+	var backends []string
+	for _, upstream := range ctrl.snapshot.Upstreams() {
+		backends = append(backends, upstream.Host)
+	}
+	sort.Strings(backends)
+	return backends
+}
+
+func equalBackends(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func (ctrl *Controller) handleErr(err error, key interface{}) {
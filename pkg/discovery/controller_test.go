@@ -0,0 +1,430 @@
+package discovery
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/events"
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/metrics"
+)
+
+func mockVirtualService(name string, namespace string, expose string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"kind":       "VirtualService",
+			"apiVersion": "appmesh.k8s.aws/v1beta1",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+				"annotations": map[string]interface{}{
+					envoy.GatewayExpose: expose,
+				},
+			},
+			"spec": map[string]interface{}{
+				"meshName": "appmesh",
+				"virtualRouter": map[string]interface{}{
+					"name": name,
+					"listeners": []interface{}{
+						map[string]interface{}{
+							"portMapping": map[string]interface{}{
+								"port":     int64(9898),
+								"protocol": "http",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func mockBackends(t *testing.T, client *fake.FakeDynamicClient) []string {
+	gvr := schema.GroupVersionResource{Group: "appmesh.k8s.aws", Version: "v1beta1", Resource: "virtualnodes"}
+	vn, err := client.Resource(gvr).Namespace("appmesh-gateway").Get("gateway", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	values, _, _ := unstructured.NestedSlice(vn.Object, "spec", "backends")
+	var backends []string
+	for _, value := range values {
+		name, _, _ := unstructured.NestedString(value.(map[string]interface{}), "virtualService", "virtualServiceName")
+		backends = append(backends, name)
+	}
+	return backends
+}
+
+func mockVirtualHosts(t *testing.T, snapshot *envoy.Snapshot) []string {
+	if err := snapshot.Push("test"); err != nil {
+		t.Fatal(err.Error())
+	}
+	snap, err := snapshot.Cache().GetSnapshot("test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var vhosts []string
+	for _, res := range snap.GetResources(resource.RouteType) {
+		for _, vh := range res.(*route.RouteConfiguration).VirtualHosts {
+			vhosts = append(vhosts, vh.Name)
+		}
+	}
+	return vhosts
+}
+
+func TestController_SyncOptOut(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	vsManager := NewVirtualServiceManager(client, false, false)
+	vnManager := NewVirtualNodeManager(client, "appmesh", "gateway", "appmesh-gateway")
+	ctrl := NewController(client, "", snapshot, vsManager, vnManager, nil, false, false)
+
+	if err := ctrl.indexer.Add(mockVirtualService("app1.test", "test", "true")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ctrl.indexer.Add(mockVirtualService("app2.test", "test", "true")); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctrl.syncAll()
+
+	if backends := mockBackends(t, client); len(backends) != 2 {
+		t.Errorf("Got backends %v wanted %v", backends, []string{"app1.test", "app2.test"})
+	}
+	if vhosts := mockVirtualHosts(t, snapshot); len(vhosts) != 2 {
+		t.Errorf("Got virtual hosts %v wanted %v", len(vhosts), 2)
+	}
+
+	// test opt-out with per-key sync
+	if err := ctrl.indexer.Update(mockVirtualService("app1.test", "test", "false")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ctrl.sync("test/app1.test"); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctrl.reconcile(false)
+
+	if _, ok := snapshot.Upstreams()["test/app1.test"]; ok {
+		t.Errorf("Got upstream %v after opt-out", "test/app1.test")
+	}
+	if backends := mockBackends(t, client); len(backends) != 1 || backends[0] != "app2.test" {
+		t.Errorf("Got backends %v wanted %v", backends, []string{"app2.test"})
+	}
+	if vhosts := mockVirtualHosts(t, snapshot); len(vhosts) != 1 {
+		t.Errorf("Got virtual hosts %v wanted %v", len(vhosts), 1)
+	}
+
+	// test opt-out with full resync
+	if err := ctrl.indexer.Update(mockVirtualService("app2.test", "test", "false")); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctrl.syncAll()
+
+	if n := snapshot.Len(); n != 0 {
+		t.Errorf("Got upstreams %v wanted %v", n, 0)
+	}
+	if backends := mockBackends(t, client); len(backends) != 0 {
+		t.Errorf("Got backends %v wanted %v", backends, []string{})
+	}
+	if vhosts := mockVirtualHosts(t, snapshot); len(vhosts) != 0 {
+		t.Errorf("Got virtual hosts %v wanted %v", len(vhosts), 0)
+	}
+}
+
+func TestController_SyncConcurrent(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	ctrl := NewController(client, "", snapshot, NewVirtualServiceManager(client, false, false),
+		NewVirtualNodeManager(client, "appmesh", "gateway", "appmesh-gateway"), nil, false, false)
+
+	// test that a full resync doesn't prune the upstreams stored by the workers
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				ctrl.syncAll()
+			}
+		}
+	}()
+
+	n := 300
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("app%d.test", i)
+		if err := ctrl.indexer.Add(mockVirtualService(name, "test", "true")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ctrl.sync("test/" + name); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if l := snapshot.Len(); l != n {
+		t.Errorf("Got upstreams %v wanted %v", l, n)
+	}
+}
+
+func TestController_QueueDepth(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	ctrl := NewController(client, "", snapshot, NewVirtualServiceManager(client, false, false),
+		NewVirtualNodeManager(client, "appmesh", "gateway", "appmesh-gateway"), nil, false, false)
+	defer ctrl.queue.ShutDown()
+
+	// test that the depth is updated on add without a worker processing the queue,
+	// the gauge is shared by the queues with the same name so the depth is relative
+	base := testutil.ToFloat64(metrics.QueueDepth)
+	ctrl.queue.Add("test/app1.test")
+	ctrl.queue.Add("test/app2.test")
+	if depth := testutil.ToFloat64(metrics.QueueDepth) - base; depth != 2 {
+		t.Errorf("Got depth %v wanted %v", depth, 2)
+	}
+
+	for i := 2; i > 0; i-- {
+		key, _ := ctrl.queue.Get()
+		ctrl.queue.Done(key)
+		if depth := testutil.ToFloat64(metrics.QueueDepth) - base; depth != float64(i-1) {
+			t.Errorf("Got depth %v wanted %v", depth, i-1)
+		}
+	}
+}
+
+func TestController_Ready(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	ctrl := NewController(client, "", snapshot, NewVirtualServiceManager(client, false, false),
+		NewVirtualNodeManager(client, "appmesh", "gateway", "appmesh-gateway"), nil, false, false)
+
+	// test not ready before the caches are synced
+	if err := ctrl.Ready(); err == nil {
+		t.Errorf("Got ready before the informer caches are synced")
+	}
+
+	// test not ready before the first snapshot
+	atomic.StoreInt32(&ctrl.synced, 1)
+	if err := ctrl.Ready(); err == nil {
+		t.Errorf("Got ready before the first snapshot")
+	}
+
+	if err := ctrl.indexer.Add(mockVirtualService("app1.test", "test", "true")); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctrl.syncAll()
+	if err := ctrl.Ready(); err != nil {
+		t.Errorf("Got error %v wanted ready", err)
+	}
+
+	// test not ready after a failed reconciliation
+	client.PrependReactor("*", "virtualnodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("API unavailable")
+	})
+	ctrl.syncAll()
+	if err := ctrl.Ready(); err == nil {
+		t.Errorf("Got ready after a failed virtual node reconciliation")
+	}
+}
+
+func mockVirtualNodeActions(client *fake.FakeDynamicClient) int {
+	var n int
+	for _, action := range client.Actions() {
+		if action.GetResource().Resource == "virtualnodes" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestController_SyncKey(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	ctrl := NewController(client, "", snapshot, NewVirtualServiceManager(client, false, false),
+		NewVirtualNodeManager(client, "appmesh", "gateway", "appmesh-gateway"), nil, false, false)
+
+	for _, name := range []string{"app1.test", "app2.test"} {
+		if err := ctrl.indexer.Add(mockVirtualService(name, "test", "true")); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	ctrl.syncAll()
+	actions := mockVirtualNodeActions(client)
+
+	// test that only the upstream of the synced key is updated
+	for _, name := range []string{"app1.test", "app2.test"} {
+		vs := mockVirtualService(name, "test", "true")
+		vs.SetAnnotations(map[string]string{envoy.GatewayExpose: "true", envoy.GatewayTimeout: "10s"})
+		if err := ctrl.indexer.Update(vs); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := ctrl.sync("test/app1.test"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if u, _ := snapshot.Load("test/app1.test"); u.Timeout != 10*time.Second {
+		t.Errorf("Got timeout %v wanted %v", u.Timeout, 10*time.Second)
+	}
+	if u, _ := snapshot.Load("test/app2.test"); u.Timeout == 10*time.Second {
+		t.Errorf("Got upstream %v updated without syncing its key", "test/app2.test")
+	}
+
+	// test that the virtual node isn't reconciled when the backends are unchanged
+	ctrl.reconcile(false)
+	if n := mockVirtualNodeActions(client); n != actions {
+		t.Errorf("Got virtual node actions %v wanted %v", n, actions)
+	}
+	if vhosts := mockVirtualHosts(t, snapshot); len(vhosts) != 2 {
+		t.Errorf("Got virtual hosts %v wanted %v", len(vhosts), 2)
+	}
+
+	// test that the virtual node is reconciled when the backends change
+	if err := ctrl.indexer.Add(mockVirtualService("app3.test", "test", "true")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ctrl.sync("test/app3.test"); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctrl.reconcile(false)
+	if n := mockVirtualNodeActions(client); n == actions {
+		t.Errorf("Got no virtual node actions after the backends changed")
+	}
+	if backends := mockBackends(t, client); len(backends) != 3 {
+		t.Errorf("Got backends %v wanted %v", backends, 3)
+	}
+}
+
+func TestController_SyncDebounce(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	ctrl := NewController(client, "", snapshot, NewVirtualServiceManager(client, false, false),
+		NewVirtualNodeManager(client, "appmesh", "gateway", "appmesh-gateway"), nil, false, false)
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ctrl.runSync(stopCh)
+		close(done)
+	}()
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+
+	// test that the changes synced during the debounce period are built in a single snapshot
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("app%d.test", i)
+		if err := ctrl.indexer.Add(mockVirtualService(name, "test", "true")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ctrl.sync("test/" + name); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if snapshot.Synced() {
+		t.Errorf("Got snapshot built before the debounce period")
+	}
+
+	time.Sleep(3 * syncDebounce)
+	if version, _ := snapshot.Version(); version != "1" {
+		t.Errorf("Got version %v wanted %v", version, "1")
+	}
+	if vhosts := mockVirtualHosts(t, snapshot); len(vhosts) != 5 {
+		t.Errorf("Got virtual hosts %v wanted %v", len(vhosts), 5)
+	}
+	if backends := mockBackends(t, client); len(backends) != 5 {
+		t.Errorf("Got backends %v wanted %v", backends, 5)
+	}
+}
+
+func mockEvents(recorder *record.FakeRecorder) []string {
+	var list []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			list = append(list, event)
+		default:
+			return list
+		}
+	}
+}
+
+func TestController_Events(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	fakeRecorder := record.NewFakeRecorder(100)
+	recorder := events.NewEventRecorder(fakeRecorder, nil)
+	ctrl := NewController(client, "", snapshot, NewVirtualServiceManager(client, false, false),
+		NewVirtualNodeManager(client, "appmesh", "gateway", "appmesh-gateway"), recorder, false, false)
+
+	update := func(name string, annotations map[string]string) {
+		vs := mockVirtualService(name, "test", "true")
+		vs.SetAnnotations(annotations)
+		if err := ctrl.indexer.Update(vs); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ctrl.sync("test/" + name); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// test that an event is recorded once per status
+	if err := ctrl.indexer.Add(mockVirtualService("app1.test", "test", "true")); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctrl.syncAll()
+	ctrl.syncAll()
+	if list := mockEvents(fakeRecorder); len(list) != 1 || !strings.HasPrefix(list[0], "Normal Exposed") {
+		t.Errorf("Got events %v wanted %v", list, "Exposed")
+	}
+
+	update("app1.test", map[string]string{envoy.GatewayExpose: "true", envoy.GatewayTimeout: "10"})
+	update("app1.test", map[string]string{envoy.GatewayExpose: "true", envoy.GatewayTimeout: "10"})
+	if list := mockEvents(fakeRecorder); len(list) != 1 || !strings.HasPrefix(list[0], "Warning InvalidAnnotations") {
+		t.Errorf("Got events %v wanted %v", list, "InvalidAnnotations")
+	}
+
+	update("app1.test", map[string]string{envoy.GatewayExpose: "false"})
+	update("app1.test", map[string]string{envoy.GatewayExpose: "false"})
+	if list := mockEvents(fakeRecorder); len(list) != 1 || !strings.HasPrefix(list[0], "Normal Skipped") {
+		t.Errorf("Got events %v wanted %v", list, "Skipped")
+	}
+
+	// test that the event is recorded again after the status changes back
+	update("app1.test", map[string]string{envoy.GatewayExpose: "true"})
+	if list := mockEvents(fakeRecorder); len(list) != 1 || !strings.HasPrefix(list[0], "Normal Exposed") {
+		t.Errorf("Got events %v wanted %v", list, "Exposed")
+	}
+
+	// test that a domain conflict is recorded once for the virtual service that lost the domain
+	if err := ctrl.indexer.Add(mockVirtualService("app2.test", "test", "true")); err != nil {
+		t.Fatal(err.Error())
+	}
+	update("app1.test", map[string]string{envoy.GatewayExpose: "true", envoy.GatewayDomain: "example.com"})
+	update("app2.test", map[string]string{envoy.GatewayExpose: "true", envoy.GatewayDomain: "example.com"})
+	mockEvents(fakeRecorder)
+	ctrl.reconcile(false)
+	ctrl.reconcile(false)
+	list := mockEvents(fakeRecorder)
+	if len(list) != 1 || !strings.HasPrefix(list[0], "Warning DomainConflict") || !strings.Contains(list[0], "test/app1.test") {
+		t.Errorf("Got events %v wanted %v", list, "DomainConflict")
+	}
+}
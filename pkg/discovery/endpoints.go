@@ -0,0 +1,44 @@
+package discovery
+
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+)
+
+// EndpointsFromUnstructured converts Kubernetes endpoints to Envoy endpoints,
+// the not ready addresses of terminating or unhealthy pods are excluded
+func EndpointsFromUnstructured(obj *unstructured.Unstructured) ([]envoy.Endpoint, error) {
+	var eps corev1.Endpoints
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &eps); err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]envoy.Endpoint, 0)
+	for _, subset := range eps.Subsets {
+		for _, port := range subset.Ports {
+			if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
+				continue
+			}
+			for _, address := range subset.Addresses {
+				endpoints = append(endpoints, envoy.Endpoint{
+					Address: address.IP,
+					Port:    uint32(port.Port),
+				})
+			}
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Address == endpoints[j].Address {
+			return endpoints[i].Port < endpoints[j].Port
+		}
+		return endpoints[i].Address < endpoints[j].Address
+	})
+
+	return endpoints, nil
+}
@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+)
+
+// RunLeaderElection campaigns for a Lease until the stop channel is closed,
+// only the leader writes the gateway virtual node while all replicas
+// keep their informers running and serve xDS from their own cache
+func (ctrl *Controller) RunLeaderElection(cfg *rest.Config, namespace string, name string, identity string, stopCh <-chan struct{}) error {
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, namespace, name,
+		kubeClient.CoreV1(), kubeClient.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		return err
+	}
+
+	ctrl.vnManager.SetLeader(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	go func() {
+		for {
+			leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+				Lock:            lock,
+				LeaseDuration:   15 * time.Second,
+				RenewDeadline:   10 * time.Second,
+				RetryPeriod:     2 * time.Second,
+				ReleaseOnCancel: true,
+				Callbacks: leaderelection.LeaderCallbacks{
+					OnStartedLeading: func(context.Context) {
+						klog.Infof("%s acquired lease %s.%s", identity, name, namespace)
+						ctrl.vnManager.SetLeader(true)
+						// before the caches sync the virtual node is reconciled by Run
+						if atomic.LoadInt32(&ctrl.synced) == 1 {
+							ctrl.syncAll()
+						}
+					},
+					OnStoppedLeading: func() {
+						klog.Infof("%s lost lease %s.%s", identity, name, namespace)
+						ctrl.vnManager.SetLeader(false)
+					},
+					OnNewLeader: func(current string) {
+						if current != identity {
+							klog.Infof("current leader is %s", current)
+						}
+					},
+				},
+			})
+
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+)
+
+// CertificateFromUnstructured converts a kubernetes.io/tls secret to an Envoy certificate
+func CertificateFromUnstructured(obj *unstructured.Unstructured) (*envoy.Certificate, error) {
+	data, _, err := unstructured.NestedStringMap(obj.Object, "data")
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := base64.StdEncoding.DecodeString(data[corev1.TLSCertKey])
+	if err != nil {
+		return nil, fmt.Errorf("%s decoding failed %v", corev1.TLSCertKey, err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("%s decoding failed %v", corev1.TLSPrivateKeyKey, err)
+	}
+
+	if len(chain) == 0 || len(key) == 0 {
+		return nil, fmt.Errorf("secret %s/%s has no TLS data", obj.GetNamespace(), obj.GetName())
+	}
+
+	return &envoy.Certificate{
+		Name:  fmt.Sprintf("%s/%s", obj.GetNamespace(), obj.GetName()),
+		Chain: chain,
+		Key:   key,
+	}, nil
+}
@@ -2,15 +2,19 @@ package discovery
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	appmeshv1 "github.com/aws/aws-app-mesh-controller-for-k8s/pkg/apis/appmesh/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/metrics"
 )
 
 // VirtualNodeManager reconciles the gateway virtual node backend
@@ -19,20 +23,44 @@ type VirtualNodeManager struct {
 	gatewayMesh      string
 	gatewayName      string
 	gatewayNamespace string
+	leader           int32
 }
 
 // NewVirtualNodeManager creates an App Mesh virtual node manager
 func NewVirtualNodeManager(client dynamic.Interface, gatewayMesh string, gatewayName string, gatewayNamespace string) *VirtualNodeManager {
-	return &VirtualNodeManager{
+	vnm := &VirtualNodeManager{
 		client:           client,
 		gatewayMesh:      gatewayMesh,
 		gatewayName:      gatewayName,
 		gatewayNamespace: gatewayNamespace,
 	}
+	vnm.SetLeader(true)
+	return vnm
+}
+
+// SetLeader enables or disables the virtual node writes,
+// when leader election is enabled only the leader reconciles the virtual node
+func (vnm *VirtualNodeManager) SetLeader(leader bool) {
+	var value int32
+	if leader {
+		value = 1
+	}
+	atomic.StoreInt32(&vnm.leader, value)
+	metrics.Leader.Set(float64(value))
+}
+
+// IsLeader returns true if this replica writes the virtual node
+func (vnm *VirtualNodeManager) IsLeader() bool {
+	return atomic.LoadInt32(&vnm.leader) == 1
 }
 
-// Reconcile creates or updates the virtual node and its backends
+// Reconcile creates or updates the virtual node and its backends,
+// it's a no-op if this replica is not the leader
 func (vnm *VirtualNodeManager) Reconcile(backends []string) error {
+	if !vnm.IsLeader() {
+		return nil
+	}
+
 	vnName := vnm.gatewayName
 	var vnBackends []appmeshv1.Backend
 	for _, value := range backends {
@@ -54,6 +82,11 @@ func (vnm *VirtualNodeManager) Reconcile(backends []string) error {
 			}},
 		Backends: vnBackends,
 	}
+	// the spec is converted to JSON compatible values so that the object can be deep copied
+	specObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&spec)
+	if err != nil {
+		return fmt.Errorf("failed to convert gateway virtual node spec: %v", err)
+	}
 
 	vn := &unstructured.Unstructured{
 		Object: map[string]interface{}{
@@ -62,7 +95,7 @@ func (vnm *VirtualNodeManager) Reconcile(backends []string) error {
 			"metadata": map[string]interface{}{
 				"name": vnName,
 			},
-			"spec": spec,
+			"spec": specObj,
 		},
 	}
 
@@ -72,7 +105,7 @@ func (vnm *VirtualNodeManager) Reconcile(backends []string) error {
 		Resource: "virtualnodes",
 	})
 
-	_, err := client.Namespace(vnm.gatewayNamespace).Get(vnName, metav1.GetOptions{})
+	_, err = client.Namespace(vnm.gatewayNamespace).Get(vnName, metav1.GetOptions{})
 	if errors.IsNotFound(err) {
 		_, createErr := client.Namespace(vnm.gatewayNamespace).Create(vn, metav1.CreateOptions{})
 		if createErr != nil && !errors.IsNotFound(createErr) {
@@ -98,7 +131,7 @@ func (vnm *VirtualNodeManager) Reconcile(backends []string) error {
 					"name":            vnName,
 					"resourceVersion": gw.GetResourceVersion(),
 				},
-				"spec": spec,
+				"spec": specObj,
 			},
 		}
 		_, err = client.Namespace(vnm.gatewayNamespace).Update(vn, metav1.UpdateOptions{})
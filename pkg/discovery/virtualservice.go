@@ -3,7 +3,6 @@ package discovery
 import (
 	"encoding/json"
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
@@ -16,20 +15,24 @@ import (
 
 // VirtualServiceManager transforms virtual service to upstreams
 type VirtualServiceManager struct {
-	client dynamic.Interface
-	optIn  bool
+	client        dynamic.Interface
+	optIn         bool
+	httpsRedirect bool
 }
 
 // NewVirtualServiceManager creates an App Mesh virtual service manager
-func NewVirtualServiceManager(client dynamic.Interface, optIn bool) *VirtualServiceManager {
+func NewVirtualServiceManager(client dynamic.Interface, optIn bool, httpsRedirect bool) *VirtualServiceManager {
 	return &VirtualServiceManager{
-		client: client,
-		optIn:  optIn,
+		client:        client,
+		optIn:         optIn,
+		httpsRedirect: httpsRedirect,
 	}
 }
 
-// ConvertToUpstream converts the App Mesh virtual service to an Upstream
-func (vsm *VirtualServiceManager) ConvertToUpstream(vs appmeshv1.VirtualService) envoy.Upstream {
+// ConvertToUpstream converts the App Mesh virtual service to an Upstream,
+// the invalid annotations are ignored or clamped to their limits and returned as errors
+func (vsm *VirtualServiceManager) ConvertToUpstream(vs appmeshv1.VirtualService) (envoy.Upstream, []error) {
+	var errs []error
 	port := uint32(80)
 	for _, value := range vs.Spec.VirtualRouter.Listeners {
 		port = uint32(value.PortMapping.Port)
@@ -41,11 +44,14 @@ func (vsm *VirtualServiceManager) ConvertToUpstream(vs appmeshv1.VirtualService)
 			vs.Name,
 			fmt.Sprintf("%s:%d", vs.Name, port),
 		},
-		Port:    port,
-		Host:    vs.Name,
-		Prefix:  "/",
-		Retries: 2,
-		Timeout: 45 * time.Second,
+		Port:          port,
+		Host:          vs.Name,
+		Prefix:        "/",
+		Retries:       2,
+		Timeout:       45 * time.Second,
+		HTTPSRedirect: vsm.httpsRedirect,
+		Service:       ServiceKey(vs.Name, vs.Namespace),
+		Created:       vs.CreationTimestamp.Time,
 	}
 
 	appendDomain := func(slice []string, i string) []string {
@@ -57,48 +63,112 @@ func (vsm *VirtualServiceManager) ConvertToUpstream(vs appmeshv1.VirtualService)
 		return append(slice, i)
 	}
 
+	errs = append(errs, envoy.UnknownAnnotations(vs.Annotations)...)
 	for key, value := range vs.Annotations {
+		if key == envoy.GatewayExpose {
+			if _, err := envoy.ParseBool(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
+			}
+		}
 		if key == envoy.GatewayDomain {
-			for _, domain := range strings.Split(value, ",") {
-				domain = strings.TrimSpace(domain)
-				if domain != "" {
-					up.Domains = appendDomain(up.Domains, domain)
+			for _, value := range strings.Split(value, ",") {
+				if strings.TrimSpace(value) == "" {
+					continue
+				}
+				domain, err := envoy.ParseDomain(value)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s %v", key, err))
+					continue
 				}
+				up.Domains = appendDomain(up.Domains, domain)
 			}
 		}
 		if key == envoy.GatewayTimeout {
-			d, err := time.ParseDuration(value)
+			d, err := envoy.ParseTimeout(value)
 			if err == nil {
 				up.Timeout = d
+			} else {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
 			}
 		}
 		if key == envoy.GatewayRetries {
-			r, err := strconv.Atoi(value)
+			r, err := envoy.ParseRetries(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
+			}
+			// an out of range value is clamped and returned with an error
+			if err == nil || r > 0 {
+				up.Retries = r
+			}
+		}
+		if key == envoy.GatewayClass && strings.TrimSpace(value) != "" {
+			if _, err := envoy.ParseName(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
+			}
+			// an invalid class is kept so that the virtual service isn't served to all groups
+			up.Class = strings.TrimSpace(value)
+		}
+		if key == envoy.GatewayHTTPSRedirect {
+			r, err := envoy.ParseBool(value)
+			if err == nil {
+				up.HTTPSRedirect = r
+			} else {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
+			}
+		}
+		if key == envoy.GatewayTLSSecret && strings.TrimSpace(value) != "" {
+			name, err := envoy.ParseName(value)
 			if err == nil {
-				up.Retries = uint32(r)
+				up.TLSSecret = fmt.Sprintf("%s/%s", vs.Namespace, name)
+			} else {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
 			}
 		}
 	}
-	return up
+
+	canary, canaryErrs := envoy.CanaryFromAnnotations(vs.Annotations)
+	errs = append(errs, canaryErrs...)
+	if canary != nil {
+		canary.PrimaryCluster = fmt.Sprintf("%s-%d", canary.PrimaryCluster, port)
+		canary.CanaryCluster = fmt.Sprintf("%s-%d", canary.CanaryCluster, port)
+		up.Canary = canary
+	}
+	return up, errs
 }
 
-// IsValid checks if a virtual service service is eligible
-func (vsm *VirtualServiceManager) IsValid(vs appmeshv1.VirtualService) bool {
-	if vs.Spec.VirtualRouter == nil ||
-		len(vs.Spec.VirtualRouter.Listeners) < 1 ||
+// ServiceKey returns the namespace/name of the Kubernetes service targeted by
+// a virtual service host e.g. podinfo.test or podinfo.test.svc.cluster.local,
+// a host without a namespace refers to a service from the virtual service namespace
+func ServiceKey(host string, namespace string) string {
+	parts := strings.Split(host, ".")
+	if len(parts) > 1 && parts[1] != "" {
+		namespace = parts[1]
+	}
+	return fmt.Sprintf("%s/%s", namespace, parts[0])
+}
+
+// IsValid checks if a virtual service service is eligible,
+// when it's not eligible the reason is returned
+func (vsm *VirtualServiceManager) IsValid(vs appmeshv1.VirtualService) (bool, string) {
+	if vs.Spec.VirtualRouter == nil {
+		return false, "virtual router is not set"
+	}
+	if len(vs.Spec.VirtualRouter.Listeners) < 1 ||
 		vs.Spec.VirtualRouter.Listeners[0].PortMapping.Port < 1 {
-		return false
+		return false, "virtual router listener port is not set"
 	}
 
-	for key, value := range vs.Annotations {
-		if vsm.optIn && key == envoy.GatewayExpose && value != "true" {
-			return false
+	// the value is parsed like in ConvertToUpstream so that e.g. "False" or "0" opts out
+	if value, ok := vs.Annotations[envoy.GatewayExpose]; ok {
+		expose, err := envoy.ParseBool(value)
+		if vsm.optIn && (err != nil || !expose) {
+			return false, fmt.Sprintf("%s is not true", envoy.GatewayExpose)
 		}
-		if key == envoy.GatewayExpose && value == "false" {
-			return false
+		if err == nil && !expose {
+			return false, fmt.Sprintf("%s is false", envoy.GatewayExpose)
 		}
 	}
-	return true
+	return true, ""
 }
 
 // VirtualServiceFromUnstructured converts an unstructured object to a virtual service
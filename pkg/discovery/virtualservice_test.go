@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+)
+
+func TestVirtualServiceManager_IsValid(t *testing.T) {
+	vsm := NewVirtualServiceManager(nil, true, false)
+
+	vs, err := vsm.VirtualServiceFromUnstructured(mockVirtualService("app.test", "test", "true"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ok, reason := vsm.IsValid(*vs); !ok {
+		t.Errorf("Got not eligible %s wanted eligible", reason)
+	}
+
+	vs.Annotations[envoy.GatewayExpose] = "no"
+	if ok, reason := vsm.IsValid(*vs); ok || reason == "" {
+		t.Errorf("Got eligible %v reason %q wanted not eligible with reason", ok, reason)
+	}
+
+	// test the boolean values accepted by the annotation validation
+	for value, expected := range map[string]bool{"True": true, "1": true, "TRUE": true, "False": false, "0": false} {
+		vs.Annotations[envoy.GatewayExpose] = value
+		if ok, _ := vsm.IsValid(*vs); ok != expected {
+			t.Errorf("Got eligible %v wanted %v for opt-in %q", ok, expected, value)
+		}
+	}
+
+	optOut := NewVirtualServiceManager(nil, false, false)
+	for value, expected := range map[string]bool{"False": false, "0": false, "FALSE": false, "f": false, "True": true, "no": true} {
+		vs.Annotations[envoy.GatewayExpose] = value
+		if ok, _ := optOut.IsValid(*vs); ok != expected {
+			t.Errorf("Got eligible %v wanted %v for opt-out %q", ok, expected, value)
+		}
+	}
+
+	vs.Annotations[envoy.GatewayExpose] = "true"
+	vs.Spec.VirtualRouter = nil
+	if ok, reason := vsm.IsValid(*vs); ok || reason != "virtual router is not set" {
+		t.Errorf("Got eligible %v reason %q wanted %q", ok, reason, "virtual router is not set")
+	}
+}
+
+func TestVirtualServiceManager_ConvertToUpstream(t *testing.T) {
+	vsm := NewVirtualServiceManager(nil, false, false)
+
+	vs, err := vsm.VirtualServiceFromUnstructured(mockVirtualService("app.test", "test", "true"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vs.Annotations[envoy.GatewayTimeout] = "10"
+	vs.Annotations[envoy.GatewayRetries] = "3"
+
+	upstream, errs := vsm.ConvertToUpstream(*vs)
+	if len(errs) != 1 {
+		t.Errorf("Got errors %v wanted %v", len(errs), 1)
+	}
+	if upstream.Timeout != 45*time.Second {
+		t.Errorf("Got timeout %v wanted %v", upstream.Timeout, 45*time.Second)
+	}
+	if upstream.Retries != 3 {
+		t.Errorf("Got retries %v wanted %v", upstream.Retries, 3)
+	}
+
+	// test that an invalid class is reported and kept
+	delete(vs.Annotations, envoy.GatewayTimeout)
+	vs.Annotations[envoy.GatewayClass] = "public gateway"
+	upstream, errs = vsm.ConvertToUpstream(*vs)
+	if len(errs) != 1 {
+		t.Errorf("Got errors %v wanted %v", errs, 1)
+	}
+	if upstream.MatchClass("public") || upstream.MatchClass("") {
+		t.Errorf("Got class %q served to all groups", upstream.Class)
+	}
+}
@@ -1,6 +1,15 @@
 package envoy
 
-import "strconv"
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
 
 const (
 	// GatewayPrefix prefix annotation
@@ -19,35 +28,235 @@ const (
 	GatewayCanary = GatewayPrefix + "canary"
 	// GatewayCanaryWeight traffic weight percentage annotation
 	GatewayCanaryWeight = GatewayPrefix + "canary-weight"
+	// GatewayCanaryMatch annotation with a JSON list of header matches that route requests to canary
+	GatewayCanaryMatch = GatewayPrefix + "canary-match"
+	// GatewayCanaryCookie annotation with the name of a cookie that routes requests to canary when set to always
+	GatewayCanaryCookie = GatewayPrefix + "canary-cookie"
+	// GatewayCanaryMirror boolean annotation that shadows the canary weight percentage instead of splitting it
+	GatewayCanaryMirror = GatewayPrefix + "canary-mirror"
+	// GatewayClass annotation with the Envoy node group that serves the virtual service
+	GatewayClass = GatewayPrefix + "gateway-class"
+	// GatewayTLSSecret annotation with the name of a kubernetes.io/tls secret used for TLS termination
+	GatewayTLSSecret = GatewayPrefix + "tls-secret"
+	// GatewayHTTPSRedirect boolean annotation that overrides the global HTTP to HTTPS redirect setting
+	GatewayHTTPSRedirect = GatewayPrefix + "https-redirect"
 )
 
-// CanaryFromAnnotations parses the annotations and returns a canary object
-func CanaryFromAnnotations(an map[string]string) *Canary {
+// MaxRetries is the upper limit of the retries annotation
+const MaxRetries = 10
+
+var knownAnnotations = map[string]bool{
+	GatewayExpose:        true,
+	GatewayDomain:        true,
+	GatewayTimeout:       true,
+	GatewayRetries:       true,
+	GatewayPrimary:       true,
+	GatewayCanary:        true,
+	GatewayCanaryWeight:  true,
+	GatewayCanaryMatch:   true,
+	GatewayCanaryCookie:  true,
+	GatewayCanaryMirror:  true,
+	GatewayClass:         true,
+	GatewayTLSSecret:     true,
+	GatewayHTTPSRedirect: true,
+}
+
+// UnknownAnnotations returns an error for each annotation with the gateway prefix that is not supported
+func UnknownAnnotations(an map[string]string) []error {
+	var errs []error
+	for key := range an {
+		if strings.HasPrefix(key, GatewayPrefix) && !knownAnnotations[key] {
+			errs = append(errs, fmt.Errorf("%s unknown annotation", key))
+		}
+	}
+	return errs
+}
+
+// ParseDomain validates a domain with an optional wildcard prefix and port e.g. *.example.com:8080
+func ParseDomain(value string) (string, error) {
+	domain := strings.ToLower(strings.TrimSpace(value))
+	host := domain
+	if i := strings.LastIndex(domain, ":"); i > -1 {
+		host = domain[:i]
+		if port, err := strconv.Atoi(domain[i+1:]); err != nil || port < 1 || port > 65535 {
+			return "", fmt.Errorf("invalid port in domain %q", value)
+		}
+	}
+	host = strings.TrimPrefix(host, "*.")
+	if errs := validation.IsDNS1123Subdomain(host); len(errs) > 0 {
+		return "", fmt.Errorf("invalid domain %q %s", value, strings.Join(errs, ", "))
+	}
+	return domain, nil
+}
+
+// ParseTimeout validates a positive duration
+func ParseTimeout(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q must be greater than zero", value)
+	}
+	return d, nil
+}
+
+// ParseRetries validates a number of retries, values over MaxRetries are clamped
+func ParseRetries(value string) (uint32, error) {
+	r, err := strconv.Atoi(value)
+	if err != nil || r < 0 {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	if r > MaxRetries {
+		return MaxRetries, fmt.Errorf("%d retries clamped to %d", r, MaxRetries)
+	}
+	return uint32(r), nil
+}
+
+// ParseBool validates a boolean
+func ParseBool(value string) (bool, error) {
+	r, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean %q", value)
+	}
+	return r, nil
+}
+
+// ParseName validates a Kubernetes object name
+func ParseName(value string) (string, error) {
+	name := strings.TrimSpace(value)
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", fmt.Errorf("invalid name %q %s", value, strings.Join(errs, ", "))
+	}
+	return name, nil
+}
+
+// cookieName matches the token characters allowed in a cookie name by RFC 6265
+var cookieName = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+
+// parseCookie validates a cookie name and returns the header match of the name=always cookie
+func parseCookie(value string) ([]HeaderMatch, error) {
+	name := strings.TrimSpace(value)
+	if !cookieName.MatchString(name) {
+		return nil, fmt.Errorf("invalid cookie name %q", value)
+	}
+	return []HeaderMatch{{
+		Name:  "cookie",
+		Regex: fmt.Sprintf("^(.*?;)?(%s=always)(;.*)?$", regexp.QuoteMeta(name)),
+	}}, nil
+}
+
+// parseWeight validates a traffic weight percentage, values outside 0-100 are clamped
+func parseWeight(value string) (int, error) {
+	r, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	if r < 0 {
+		return 0, fmt.Errorf("weight %d clamped to 0", r)
+	}
+	if r > 100 {
+		return 100, fmt.Errorf("weight %d clamped to 100", r)
+	}
+	return r, nil
+}
+
+// parseMatch validates a JSON list of header matches,
+// a match must have a name and at most one of exact, prefix or regex
+func parseMatch(value string) ([]HeaderMatch, error) {
+	var match []HeaderMatch
+	if err := json.Unmarshal([]byte(value), &match); err != nil {
+		return nil, fmt.Errorf("invalid JSON %v", err)
+	}
+	for _, m := range match {
+		if strings.TrimSpace(m.Name) == "" {
+			return nil, fmt.Errorf("header name is not set")
+		}
+		set := 0
+		for _, v := range []string{m.Exact, m.Prefix, m.Regex} {
+			if v != "" {
+				set++
+			}
+		}
+		if set > 1 {
+			return nil, fmt.Errorf("header %s has more than one of exact, prefix and regex", m.Name)
+		}
+		if m.Regex != "" {
+			if _, err := regexp.Compile(m.Regex); err != nil {
+				return nil, fmt.Errorf("header %s invalid regex %v", m.Name, err)
+			}
+		}
+	}
+	return match, nil
+}
+
+// CanaryFromAnnotations parses the annotations and returns a canary object,
+// the invalid annotations are ignored or clamped and returned as errors
+func CanaryFromAnnotations(an map[string]string) (*Canary, []error) {
 	var primaryCluster string
 	var canaryCluster string
 	var canaryWeight int
+	var match []HeaderMatch
+	var cookie []HeaderMatch
+	var mirror bool
+	var errs []error
 	for key, value := range an {
 		if key == GatewayPrimary {
-			primaryCluster = value
+			name, err := ParseName(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
+			}
+			primaryCluster = name
 		}
 		if key == GatewayCanary {
-			canaryCluster = value
+			name, err := ParseName(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
+			}
+			canaryCluster = name
 		}
 		if key == GatewayCanaryWeight {
-			r, err := strconv.Atoi(value)
-			if err == nil {
-				canaryWeight = r
+			r, err := parseWeight(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
+			}
+			canaryWeight = r
+		}
+		if key == GatewayCanaryMatch {
+			m, err := parseMatch(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
+			}
+			match = m
+		}
+		if key == GatewayCanaryMirror {
+			r, err := ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
 			}
+			mirror = r
+		}
+		if key == GatewayCanaryCookie && strings.TrimSpace(value) != "" {
+			m, err := parseCookie(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %v", key, err))
+			}
+			cookie = m
 		}
 	}
 
+	// the header matches are followed by the cookie match so that the order doesn't depend on the map iteration
+	match = append(match, cookie...)
+
 	if primaryCluster != "" && canaryCluster != "" {
 		return &Canary{
 			PrimaryCluster: primaryCluster,
 			CanaryCluster:  canaryCluster,
 			CanaryWeight:   canaryWeight,
-		}
+			Match:          match,
+			Mirror:         mirror,
+		}, errs
 	}
 
-	return nil
+	return nil, errs
 }
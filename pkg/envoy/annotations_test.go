@@ -0,0 +1,99 @@
+package envoy
+
+import (
+	"testing"
+)
+
+func TestCanaryFromAnnotations_Validation(t *testing.T) {
+	canary, errs := CanaryFromAnnotations(map[string]string{
+		GatewayPrimary:      "app-primary.test",
+		GatewayCanary:       "app-canary.test",
+		GatewayCanaryWeight: "150",
+		GatewayCanaryMatch:  `[{"name":"x-canary","exact":"insider","regex":".*"}]`,
+	})
+
+	if canary == nil {
+		t.Fatal("Got nil canary")
+	}
+	if canary.CanaryWeight != 100 {
+		t.Errorf("Got weight %v wanted %v", canary.CanaryWeight, 100)
+	}
+	if len(canary.Match) != 0 {
+		t.Errorf("Got matches %v wanted %v", len(canary.Match), 0)
+	}
+	if len(errs) != 2 {
+		t.Errorf("Got errors %v wanted %v", errs, 2)
+	}
+
+	canary, errs = CanaryFromAnnotations(map[string]string{
+		GatewayPrimary: "App_Primary",
+		GatewayCanary:  "app-canary.test",
+	})
+	if canary != nil {
+		t.Errorf("Got canary %v wanted nil", canary)
+	}
+	if len(errs) != 1 {
+		t.Errorf("Got errors %v wanted %v", errs, 1)
+	}
+
+	// test that an invalid cookie name is ignored
+	canary, errs = CanaryFromAnnotations(map[string]string{
+		GatewayPrimary:      "app-primary.test",
+		GatewayCanary:       "app-canary.test",
+		GatewayCanaryCookie: "canary=always; insider",
+	})
+	if canary == nil {
+		t.Fatal("Got nil canary")
+	}
+	if len(canary.Match) != 0 {
+		t.Errorf("Got matches %v wanted %v", canary.Match, 0)
+	}
+	if len(errs) != 1 {
+		t.Errorf("Got errors %v wanted %v", errs, 1)
+	}
+
+	canary, errs = CanaryFromAnnotations(map[string]string{
+		GatewayPrimary:      "app-primary.test",
+		GatewayCanary:       "app-canary.test",
+		GatewayCanaryCookie: " flagger.canary_v2 ",
+	})
+	if len(errs) != 0 || canary == nil || len(canary.Match) != 1 {
+		t.Errorf("Got canary %v errors %v wanted one cookie match", canary, errs)
+	}
+}
+
+func TestParseDomain(t *testing.T) {
+	valid := map[string]string{
+		"example.com":        "example.com",
+		" WWW.Example.com ":  "www.example.com",
+		"*.example.com":      "*.example.com",
+		"example.com:8080":   "example.com:8080",
+		"app.test.svc.local": "app.test.svc.local",
+	}
+	for value, expected := range valid {
+		domain, err := ParseDomain(value)
+		if err != nil {
+			t.Errorf("Got error %v for %q", err, value)
+		}
+		if domain != expected {
+			t.Errorf("Got domain %v wanted %v", domain, expected)
+		}
+	}
+
+	for _, value := range []string{"example.com:0", "example..com", "exa mple.com", "*", "example.com/"} {
+		if _, err := ParseDomain(value); err == nil {
+			t.Errorf("Got no error for %q", value)
+		}
+	}
+}
+
+func TestUnknownAnnotations(t *testing.T) {
+	errs := UnknownAnnotations(map[string]string{
+		GatewayExpose:                "true",
+		GatewayPrefix + "timeuot":    "10s",
+		"kubernetes.io/change-cause": "test",
+	})
+	if len(errs) != 1 {
+		t.Errorf("Got errors %v wanted %v", errs, 1)
+	}
+}
@@ -1,21 +1,29 @@
 package envoy
 
 import (
-	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"k8s.io/klog"
 )
 
-// NewCache creates an Envoy cache
-func NewCache(ads bool) cache.SnapshotCache {
-	return cache.NewSnapshotCache(ads, Hasher{}, log{})
+// NewCache creates an Envoy cache with snapshots indexed by node group
+func NewCache(ads bool, hasher Hasher) cache.SnapshotCache {
+	return cache.NewSnapshotCache(ads, hasher, log{})
 }
 
 type log struct{}
 
+func (l log) Debugf(format string, args ...interface{}) {
+	klog.V(5).Infof(format, args...)
+}
+
 func (l log) Infof(format string, args ...interface{}) {
 	klog.V(4).Infof(format, args...)
 }
 
+func (l log) Warnf(format string, args ...interface{}) {
+	klog.Warningf(format, args...)
+}
+
 func (l log) Errorf(format string, args ...interface{}) {
 	klog.Errorf(format, args...)
 }
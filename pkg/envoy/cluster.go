@@ -3,22 +3,21 @@ package envoy
 import (
 	"time"
 
-	envoyv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
-	cluster "github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
-	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
-	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
-	"github.com/golang/protobuf/ptypes"
-	"github.com/golang/protobuf/ptypes/wrappers"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
-func newCluster(upstream Upstream, timeout time.Duration) *envoyv2.Cluster {
-	return &envoyv2.Cluster{
+func newCluster(upstream Upstream, timeout time.Duration) *cluster.Cluster {
+	return &cluster.Cluster{
 		Name:                 upstream.Name,
-		ConnectTimeout:       ptypes.DurationProto(timeout),
-		ClusterDiscoveryType: &envoyv2.Cluster_Type{Type: envoyv2.Cluster_STRICT_DNS},
-		DnsLookupFamily:      envoyv2.Cluster_V4_ONLY,
-		LbPolicy:             envoyv2.Cluster_LEAST_REQUEST,
-		LoadAssignment: &envoyv2.ClusterLoadAssignment{
+		ConnectTimeout:       durationpb.New(timeout),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_STRICT_DNS},
+		DnsLookupFamily:      cluster.Cluster_V4_ONLY,
+		LbPolicy:             cluster.Cluster_LEAST_REQUEST,
+		LoadAssignment: &endpoint.ClusterLoadAssignment{
 			ClusterName: upstream.Name,
 			Endpoints: []*endpoint.LocalityLbEndpoints{{
 				LbEndpoints: []*endpoint.LbEndpoint{{
@@ -32,7 +31,25 @@ func newCluster(upstream Upstream, timeout time.Duration) *envoyv2.Cluster {
 		},
 		CircuitBreakers: &cluster.CircuitBreakers{
 			Thresholds: []*cluster.CircuitBreakers_Thresholds{{
-				MaxRetries: &wrappers.UInt32Value{Value: uint32(1024)},
+				MaxRetries: &wrapperspb.UInt32Value{Value: uint32(1024)},
+			}},
+		},
+	}
+}
+
+// newEDSCluster creates a cluster that fetches its endpoints over ADS
+func newEDSCluster(upstream Upstream, timeout time.Duration) *cluster.Cluster {
+	return &cluster.Cluster{
+		Name:                 upstream.Name,
+		ConnectTimeout:       durationpb.New(timeout),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
+		EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
+			EdsConfig: newAdsConfigSource(),
+		},
+		LbPolicy: cluster.Cluster_LEAST_REQUEST,
+		CircuitBreakers: &cluster.CircuitBreakers{
+			Thresholds: []*cluster.CircuitBreakers_Thresholds{{
+				MaxRetries: &wrapperspb.UInt32Value{Value: uint32(1024)},
 			}},
 		},
 	}
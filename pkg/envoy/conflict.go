@@ -0,0 +1,77 @@
+package envoy
+
+import (
+	"sort"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/metrics"
+)
+
+// Conflict is a domain claimed by more than one upstream served to the same node group,
+// the domain is dropped from the upstream and served only by the winner
+type Conflict struct {
+	Domain   string `json:"domain"`
+	Upstream string `json:"upstream"`
+	Winner   string `json:"winner"`
+}
+
+// Conflicts returns the domain conflicts of the last sync
+func (s *Snapshot) Conflicts() []Conflict {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Conflict(nil), s.conflicts...)
+}
+
+// Precedes returns true if the upstream wins the domains it shares with the other upstream,
+// the older upstream wins and the key decides between upstreams created at the same time
+func Precedes(key string, upstream Upstream, otherKey string, other Upstream) bool {
+	if !upstream.Created.Equal(other.Created) {
+		return upstream.Created.Before(other.Created)
+	}
+	return key < otherKey
+}
+
+// resolveConflicts drops the domains claimed by an older upstream,
+// the upstreams are ordered by creation time and by key when created at the same time,
+// an upstream left without domains is removed since Envoy rejects virtual hosts without domains
+func resolveConflicts(upstreams map[string]Upstream) []Conflict {
+	keys := make([]string, 0, len(upstreams))
+	for key := range upstreams {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return Precedes(keys[i], upstreams[keys[i]], keys[j], upstreams[keys[j]])
+	})
+
+	var conflicts []Conflict
+	claims := make(map[string][]string)
+	for _, key := range keys {
+		upstream := upstreams[key]
+		var domains []string
+		for _, domain := range upstream.Domains {
+			winner := ""
+			for _, claimant := range claims[domain] {
+				if upstream.overlaps(upstreams[claimant]) {
+					winner = claimant
+					break
+				}
+			}
+			if winner != "" {
+				conflicts = append(conflicts, Conflict{Domain: domain, Upstream: key, Winner: winner})
+				continue
+			}
+			domains = append(domains, domain)
+			claims[domain] = append(claims[domain], key)
+		}
+
+		switch {
+		case len(domains) == 0:
+			delete(upstreams, key)
+		case len(domains) != len(upstream.Domains):
+			upstream.Domains = domains
+			upstreams[key] = upstream
+		}
+	}
+
+	metrics.DomainConflicts.Set(float64(len(conflicts)))
+	return conflicts
+}
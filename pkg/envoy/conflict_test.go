@@ -0,0 +1,76 @@
+package envoy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshot_SyncConflicts(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodeId := "test"
+	mockNode(cache, nodeId)
+
+	created := time.Now()
+	for i, domains := range [][]string{
+		{"app0.test", "example.com"},
+		{"app1.test", "example.com", "www.example.com"},
+		{"example.com"},
+	} {
+		key, u := mockUpstream(i, "/")
+		u.Domains = domains
+		u.Created = created.Add(time.Duration(i) * time.Minute)
+		snapshot.Store(key, u)
+	}
+
+	// upstreams of different classes can claim the same domain
+	for i, class := range []string{"internal", "public"} {
+		key, u := mockUpstream(i+3, "/")
+		u.Domains = []string{"api.example.com"}
+		u.Class = class
+		snapshot.Store(key, u)
+	}
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conflicts := snapshot.Conflicts()
+	if len(conflicts) != 2 {
+		t.Fatalf("Got conflicts %v wanted %v", conflicts, 2)
+	}
+	for _, conflict := range conflicts {
+		if conflict.Domain != "example.com" || conflict.Winner != "test/app0" {
+			t.Errorf("Got conflict %v wanted domain %v won by %v", conflict, "example.com", "test/app0")
+		}
+	}
+
+	current := snapshot.current.Upstreams
+	if domains := current["test/app1"].Domains; len(domains) != 2 || domains[1] != "www.example.com" {
+		t.Errorf("Got domains %v wanted %v", domains, []string{"app1.test", "www.example.com"})
+	}
+	if _, ok := current["test/app2"]; ok {
+		t.Errorf("Got upstream %v without domains", "test/app2")
+	}
+	if len(current) != 4 {
+		t.Errorf("Got upstreams %v wanted %v", len(current), 4)
+	}
+
+	// test that the stored upstreams are not modified
+	if domains := snapshot.Upstreams()["test/app1"].Domains; len(domains) != 3 {
+		t.Errorf("Got stored domains %v wanted %v", len(domains), 3)
+	}
+
+	// test conflict resolution when the older upstream is removed
+	snapshot.Delete("test/app0")
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conflicts = snapshot.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Upstream != "test/app2" || conflicts[0].Winner != "test/app1" {
+		t.Errorf("Got conflicts %v wanted %v", conflicts, []Conflict{{"example.com", "test/app2", "test/app1"}})
+	}
+}
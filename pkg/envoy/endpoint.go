@@ -0,0 +1,54 @@
+package envoy
+
+import (
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+)
+
+// Endpoint is a compact form of a Kubernetes endpoint address
+type Endpoint struct {
+	Address string `json:"address"`
+	Port    uint32 `json:"port"`
+}
+
+// upstreamEndpoints selects the endpoints of an upstream port, when the endpoints
+// expose more than one port they are matched by the upstream port number,
+// it returns false if no port matches since the endpoint ports are the container ports
+// that can differ from the service port and Envoy should resolve the service with DNS instead
+func upstreamEndpoints(upstream Upstream, endpoints []Endpoint) ([]Endpoint, bool) {
+	ports := make(map[uint32]bool)
+	for _, ep := range endpoints {
+		ports[ep.Port] = true
+	}
+	if len(ports) < 2 {
+		return endpoints, true
+	}
+
+	var selected []Endpoint
+	for _, ep := range endpoints {
+		if ep.Port == upstream.Port {
+			selected = append(selected, ep)
+		}
+	}
+	return selected, len(selected) > 0
+}
+
+// newLoadAssignment creates the EDS load assignment of an upstream
+func newLoadAssignment(upstream Upstream, endpoints []Endpoint) *endpoint.ClusterLoadAssignment {
+	var lbEndpoints []*endpoint.LbEndpoint
+	for _, ep := range endpoints {
+		lbEndpoints = append(lbEndpoints, &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: newAddress(ep.Address, ep.Port),
+				},
+			},
+		})
+	}
+
+	return &endpoint.ClusterLoadAssignment{
+		ClusterName: upstream.Name,
+		Endpoints: []*endpoint.LocalityLbEndpoints{{
+			LbEndpoints: lbEndpoints,
+		}},
+	}
+}
@@ -0,0 +1,73 @@
+package envoy
+
+import (
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+func TestUpstreamEndpoints(t *testing.T) {
+	_, upstream := mockUpstream(0, "/")
+	upstream.Port = 80
+
+	// test single target port that differs from the service port
+	eps, ok := upstreamEndpoints(upstream, []Endpoint{
+		{Address: "10.0.0.1", Port: 8080},
+		{Address: "10.0.0.2", Port: 8080},
+	})
+	if !ok || len(eps) != 2 {
+		t.Errorf("Got endpoints %v %v wanted %v", len(eps), ok, 2)
+	}
+
+	// test several target ports that differ from the service port
+	multi := []Endpoint{
+		{Address: "10.0.0.1", Port: 8080},
+		{Address: "10.0.0.1", Port: 9797},
+	}
+	if eps, ok := upstreamEndpoints(upstream, multi); ok {
+		t.Errorf("Got endpoints %v wanted DNS fallback", eps)
+	}
+
+	// test several target ports matched by port number
+	upstream.Port = 8080
+	eps, ok = upstreamEndpoints(upstream, multi)
+	if !ok || len(eps) != 1 || eps[0].Port != 8080 {
+		t.Errorf("Got endpoints %v wanted port %v", eps, 8080)
+	}
+}
+
+func TestSnapshot_SyncEndpointsFallback(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodeId := "test"
+	mockNode(cache, nodeId)
+
+	key, upstream := mockUpstream(0, "/")
+	upstream.Port = 80
+	upstream.Service = key
+	snapshot.Store(key, upstream)
+	snapshot.StoreEndpoints(key, []Endpoint{
+		{Address: "10.0.0.1", Port: 8080},
+		{Address: "10.0.0.1", Port: 9797},
+	})
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snap, err := snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snap.GetResources(resource.EndpointType)) != 0 {
+		t.Errorf("Got endpoints %v wanted %v", len(snap.GetResources(resource.EndpointType)), 0)
+	}
+
+	c := snap.GetResources(resource.ClusterType)[upstream.Name].(*cluster.Cluster)
+	if c.GetType() != cluster.Cluster_STRICT_DNS {
+		t.Errorf("Got cluster type %v wanted %v", c.GetType(), cluster.Cluster_STRICT_DNS)
+	}
+}
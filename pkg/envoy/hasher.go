@@ -1,14 +1,41 @@
 package envoy
 
-import envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+import (
+	"strings"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+const (
+	// GroupByID groups Envoy nodes by node ID
+	GroupByID = "id"
+	// GroupByCluster groups Envoy nodes by node cluster
+	GroupByCluster = "cluster"
+	// GroupByMetadataPrefix groups Envoy nodes by the value of a node metadata key e.g. metadata.gateway
+	GroupByMetadataPrefix = "metadata."
+)
 
 // Hasher computes string identifiers for Envoy nodes.
-type Hasher struct{}
+// Nodes with the same identifier form a group and share the same snapshot.
+type Hasher struct {
+	GroupBy string
+}
 
-// ID returns the Envoy node ID
+// ID returns the Envoy node group
 func (h Hasher) ID(node *envoycore.Node) string {
 	if node == nil {
 		return "envoy"
 	}
+
+	switch {
+	case h.GroupBy == GroupByCluster && node.Cluster != "":
+		return node.Cluster
+	case strings.HasPrefix(h.GroupBy, GroupByMetadataPrefix) && node.Metadata != nil:
+		key := strings.TrimPrefix(h.GroupBy, GroupByMetadataPrefix)
+		if value, ok := node.Metadata.Fields[key]; ok && value.GetStringValue() != "" {
+			return value.GetStringValue()
+		}
+	}
+
 	return node.Id
 }
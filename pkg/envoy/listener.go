@@ -1,24 +1,28 @@
 package envoy
 
 import (
+	"sort"
 	"time"
 
-	envoyv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
-	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
-	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
-	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	router "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	tlsinspector "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/tls_inspector/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
-	"github.com/golang/protobuf/ptypes"
-	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
-func newListener(name, address string, port uint32, cm *hcm.HttpConnectionManager) (*envoyv2.Listener, error) {
-	cmAny, err := ptypes.MarshalAny(cm)
+func newListener(name, address string, port uint32, cm *hcm.HttpConnectionManager) (*listener.Listener, error) {
+	cmAny, err := anypb.New(cm)
 	if err != nil {
 		return nil, err
 	}
 
-	return &envoyv2.Listener{
+	return &listener.Listener{
 		Name:    name,
 		Address: newAddress(address, port),
 		FilterChains: []*listener.FilterChain{{
@@ -32,21 +36,92 @@ func newListener(name, address string, port uint32, cm *hcm.HttpConnectionManage
 	}, nil
 }
 
-func newConnectionManager(routeName string, vhosts []*route.VirtualHost, drainTimeout time.Duration) *hcm.HttpConnectionManager {
+// newTLSListener creates a listener with a filter chain for each certificate,
+// the filter chains are matched by SNI using the certificate server names
+func newTLSListener(name, address string, port uint32, cm *hcm.HttpConnectionManager, serverNames map[string][]string) (*listener.Listener, error) {
+	cmAny, err := anypb.New(cm)
+	if err != nil {
+		return nil, err
+	}
+
+	inspectorAny, err := anypb.New(&tlsinspector.TlsInspector{})
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []string
+	for secret := range serverNames {
+		secrets = append(secrets, secret)
+	}
+	sort.Strings(secrets)
+
+	var chains []*listener.FilterChain
+	for _, secret := range secrets {
+		tlsAny, err := anypb.New(&tls.DownstreamTlsContext{
+			CommonTlsContext: &tls.CommonTlsContext{
+				TlsCertificateSdsSecretConfigs: []*tls.SdsSecretConfig{newSdsSecretConfig(secret)},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		chains = append(chains, &listener.FilterChain{
+			FilterChainMatch: &listener.FilterChainMatch{
+				ServerNames: serverNames[secret],
+			},
+			TransportSocket: &envoycore.TransportSocket{
+				Name: wellknown.TransportSocketTLS,
+				ConfigType: &envoycore.TransportSocket_TypedConfig{
+					TypedConfig: tlsAny,
+				},
+			},
+			Filters: []*listener.Filter{{
+				Name: wellknown.HTTPConnectionManager,
+				ConfigType: &listener.Filter_TypedConfig{
+					TypedConfig: cmAny,
+				},
+			}},
+		})
+	}
+
+	return &listener.Listener{
+		Name:    name,
+		Address: newAddress(address, port),
+		ListenerFilters: []*listener.ListenerFilter{{
+			Name: wellknown.TLSInspector,
+			ConfigType: &listener.ListenerFilter_TypedConfig{
+				TypedConfig: inspectorAny,
+			},
+		}},
+		FilterChains: chains,
+	}, nil
+}
+
+// newConnectionManager creates a connection manager that fetches
+// the route configuration by name over ADS
+func newConnectionManager(routeName, statPrefix string, drainTimeout time.Duration) (*hcm.HttpConnectionManager, error) {
+	routerAny, err := anypb.New(&router.Router{})
+	if err != nil {
+		return nil, err
+	}
+
 	return &hcm.HttpConnectionManager{
 		CodecType:    hcm.HttpConnectionManager_AUTO,
-		DrainTimeout: ptypes.DurationProto(drainTimeout),
-		StatPrefix:   "ingress_http",
-		RouteSpecifier: &hcm.HttpConnectionManager_RouteConfig{
-			RouteConfig: &envoyv2.RouteConfiguration{
-				Name:             routeName,
-				VirtualHosts:     vhosts,
-				ValidateClusters: &wrappers.BoolValue{Value: true},
+		DrainTimeout: durationpb.New(drainTimeout),
+		StatPrefix:   statPrefix,
+		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
+			Rds: &hcm.Rds{
+				RouteConfigName: routeName,
+				ConfigSource:    newAdsConfigSource(),
 			},
 		},
 		HttpFilters: []*hcm.HttpFilter{{
 			Name: wellknown.Router,
+			ConfigType: &hcm.HttpFilter_TypedConfig{
+				TypedConfig: routerAny,
+			},
 		}},
-		UseRemoteAddress: &wrappers.BoolValue{Value: true},
-	}
+		UseRemoteAddress: &wrapperspb.BoolValue{Value: true},
+	}, nil
 }
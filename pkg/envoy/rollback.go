@@ -0,0 +1,220 @@
+package envoy
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"k8s.io/klog"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/metrics"
+)
+
+// rollback holds the upstreams accepted and rejected by Envoy,
+// while searching for the upstreams that caused a rejection,
+// half of the suspects are excluded from each snapshot until
+// Envoy accepts or rejects it
+type rollback struct {
+	good     map[string]Upstream
+	rejected map[string]Upstream
+	suspects []string
+	excluded map[string]bool
+	resolved string
+}
+
+func newRollback() *rollback {
+	return &rollback{
+		good:     make(map[string]Upstream),
+		rejected: make(map[string]Upstream),
+		excluded: make(map[string]bool),
+	}
+}
+
+// Accept marks the upstreams of a node group as good
+// when Envoy acks all the resources of the current version
+func (s *Snapshot) Accept(group string, version string) error {
+	if s.accept(group, version) {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Reject excludes the upstreams that caused Envoy to reject the current version,
+// the offending upstreams are identified by resource name in the error message
+// or by bisecting the upstreams that changed since the last accepted version,
+// a rejection is ignored until the node has acked the clusters of the version
+// since the routes can reach Envoy before the clusters they reference
+func (s *Snapshot) Reject(group string, version string, message string, clustersAcked bool) error {
+	if !clustersAcked {
+		klog.Infof("ignoring the rejection of version %s until the clusters are acked", version)
+		return nil
+	}
+	if s.reject(group, version, message) {
+		return s.Sync()
+	}
+	return nil
+}
+
+// accept returns true if the search for rejected upstreams advanced
+func (s *Snapshot) accept(group string, version string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version != fmt.Sprint(atomic.LoadUint64(&s.version)) {
+		return false
+	}
+
+	rb := s.rollback
+	for key, upstream := range s.current.Upstreams {
+		if upstream.MatchClass(group) {
+			rb.good[key] = upstream
+		}
+	}
+
+	// the included suspects are good, so the culprits are among the excluded ones
+	if len(rb.suspects) == 0 || rb.resolved == version || len(s.includedSuspects(group)) == 0 {
+		return false
+	}
+
+	var excluded []string
+	for _, key := range rb.suspects {
+		if rb.excluded[key] {
+			excluded = append(excluded, key)
+		}
+	}
+	rb.resolved = version
+	s.bisect(excluded)
+	return true
+}
+
+// reject returns true if the search for rejected upstreams advanced
+func (s *Snapshot) reject(group string, version string, message string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version != fmt.Sprint(atomic.LoadUint64(&s.version)) || s.rollback.resolved == version {
+		return false
+	}
+
+	rb := s.rollback
+	var suspects []string
+	if len(rb.suspects) > 0 {
+		suspects = s.includedSuspects(group)
+	} else {
+		for key, upstream := range s.current.Upstreams {
+			if !upstream.MatchClass(group) {
+				continue
+			}
+			if good, ok := rb.good[key]; !ok || !reflect.DeepEqual(good, upstream) {
+				suspects = append(suspects, key)
+			}
+		}
+
+		var named []string
+		for _, key := range suspects {
+			if strings.Contains(message, s.current.Upstreams[key].Name) {
+				named = append(named, key)
+			}
+		}
+		if len(named) > 0 {
+			suspects = named
+		}
+	}
+
+	// the upstreams never accepted by Envoy are not blamed for unknown clusters
+	// since their clusters may have been sent after the routes
+	if strings.Contains(message, "unknown cluster") {
+		var accepted []string
+		for _, key := range suspects {
+			if _, ok := rb.good[key]; ok {
+				accepted = append(accepted, key)
+			}
+		}
+		if len(accepted) == 0 {
+			klog.Infof("rejected version %s references clusters not yet accepted", version)
+			return false
+		}
+		suspects = accepted
+	}
+
+	sort.Strings(suspects)
+	rb.resolved = version
+	s.bisect(suspects)
+	return true
+}
+
+// includedSuspects returns the suspects served to a node group in the current version
+func (s *Snapshot) includedSuspects(group string) []string {
+	var included []string
+	for _, key := range s.rollback.suspects {
+		if upstream, ok := s.current.Upstreams[key]; ok && !s.rollback.excluded[key] && upstream.MatchClass(group) {
+			included = append(included, key)
+		}
+	}
+	return included
+}
+
+// bisect narrows down the suspects, a single suspect is rejected
+// until its spec changes, otherwise half of the suspects are excluded
+func (s *Snapshot) bisect(suspects []string) {
+	rb := s.rollback
+	rb.suspects = nil
+	rb.excluded = make(map[string]bool)
+
+	switch len(suspects) {
+	case 0:
+		klog.Errorf("rejected version %s can't be attributed to an upstream", rb.resolved)
+	case 1:
+		if value, ok := s.upstreams.Load(suspects[0]); ok {
+			rb.rejected[suspects[0]] = value.(Upstream)
+			klog.Errorf("upstream %s rejected by Envoy, serving its last accepted version", suspects[0])
+		}
+	default:
+		rb.suspects = suspects
+		for _, key := range suspects[:len(suspects)/2] {
+			rb.excluded[key] = true
+		}
+		klog.Infof("searching the rejected upstreams among %d suspects, excluding %d", len(suspects), len(rb.excluded))
+	}
+
+	metrics.RejectedUpstreams.Set(float64(len(rb.rejected)))
+}
+
+// exclude replaces the rejected and excluded upstreams with their last accepted version,
+// the upstreams that were never accepted are removed
+func (s *Snapshot) exclude(upstreams map[string]Upstream) {
+	rb := s.rollback
+	for key := range rb.good {
+		if _, ok := upstreams[key]; !ok {
+			delete(rb.good, key)
+		}
+	}
+
+	for key, upstream := range upstreams {
+		if rejected, ok := rb.rejected[key]; ok {
+			if !reflect.DeepEqual(rejected, upstream) {
+				delete(rb.rejected, key)
+				continue
+			}
+		} else if !rb.excluded[key] {
+			continue
+		}
+
+		if good, ok := rb.good[key]; ok {
+			upstreams[key] = good
+		} else {
+			delete(upstreams, key)
+		}
+	}
+
+	for key := range rb.rejected {
+		if _, ok := upstreams[key]; !ok {
+			if _, stored := s.upstreams.Load(key); !stored {
+				delete(rb.rejected, key)
+			}
+		}
+	}
+	metrics.RejectedUpstreams.Set(float64(len(rb.rejected)))
+}
@@ -0,0 +1,192 @@
+package envoy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshot_RejectBisect(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodeId := "test"
+	mockNode(cache, nodeId)
+
+	for key, value := range mockUpstreams("/") {
+		snapshot.Store(key, value)
+	}
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = snapshot.Accept(nodeId, "1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// test update of a good and a bad upstream
+	goodKey, good := mockUpstream(3, "/")
+	good.Retries = 5
+	snapshot.Store(goodKey, good)
+
+	badKey, bad := mockUpstream(5, "/")
+	bad.Timeout = time.Hour
+	snapshot.Store(badKey, bad)
+
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// test bisect without resource names
+	err = snapshot.Reject(nodeId, "2", "invalid config", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if snapshot.current.Upstreams[goodKey].Retries != 2 {
+		t.Errorf("Got retries %v wanted %v while excluded", snapshot.current.Upstreams[goodKey].Retries, 2)
+	}
+
+	if snapshot.current.Upstreams[badKey].Timeout != time.Hour {
+		t.Errorf("Got timeout %v wanted %v while included", snapshot.current.Upstreams[badKey].Timeout, time.Hour)
+	}
+
+	err = snapshot.Reject(nodeId, "3", "invalid config", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if snapshot.current.Upstreams[goodKey].Retries != 5 {
+		t.Errorf("Got retries %v wanted %v", snapshot.current.Upstreams[goodKey].Retries, 5)
+	}
+
+	if snapshot.current.Upstreams[badKey].Timeout != 2*time.Second {
+		t.Errorf("Got timeout %v wanted %v after rollback", snapshot.current.Upstreams[badKey].Timeout, 2*time.Second)
+	}
+
+	// test rejected upstream update
+	bad.Timeout = time.Minute
+	snapshot.Store(badKey, bad)
+
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if snapshot.current.Upstreams[badKey].Timeout != time.Minute {
+		t.Errorf("Got timeout %v wanted %v after update", snapshot.current.Upstreams[badKey].Timeout, time.Minute)
+	}
+}
+
+func TestSnapshot_RejectByName(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodeId := "test"
+	mockNode(cache, nodeId)
+
+	for key, value := range mockUpstreams("/") {
+		snapshot.Store(key, value)
+	}
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// test rejection of a new upstream
+	badKey, bad := mockUpstream(10, "/")
+	snapshot.Store(badKey, bad)
+
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = snapshot.Reject(nodeId, "2", "cluster 'app10-test-9898' is invalid", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snapshot.current.Upstreams) != 10 {
+		t.Errorf("Got upstreams %v wanted %v", len(snapshot.current.Upstreams), 10)
+	}
+
+	if _, ok := snapshot.current.Upstreams[badKey]; ok {
+		t.Errorf("Got upstream %v wanted none", badKey)
+	}
+
+	// test stale rejection
+	err = snapshot.Reject(nodeId, "2", "cluster 'app10-test-9898' is invalid", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snapshot.rollback.rejected) != 1 {
+		t.Errorf("Got rejected %v wanted %v", len(snapshot.rollback.rejected), 1)
+	}
+}
+
+func TestSnapshot_RejectUnknownCluster(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodeId := "test"
+	mockNode(cache, nodeId)
+
+	for key, value := range mockUpstreams("/") {
+		snapshot.Store(key, value)
+	}
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = snapshot.Accept(nodeId, "1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// test that a new upstream isn't blamed for the routes received ahead of its cluster
+	newKey, upstream := mockUpstream(10, "/")
+	snapshot.Store(newKey, upstream)
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = snapshot.Reject(nodeId, "2", "route: unknown cluster 'app10-test-9898'", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, ok := snapshot.current.Upstreams[newKey]; !ok {
+		t.Errorf("Got upstream %v excluded wanted served", newKey)
+	}
+	if len(snapshot.rollback.rejected) != 0 || len(snapshot.rollback.excluded) != 0 {
+		t.Errorf("Got rejected %v excluded %v wanted none", snapshot.rollback.rejected, snapshot.rollback.excluded)
+	}
+
+	// test that a rejection is ignored until the clusters are acked
+	err = snapshot.Reject(nodeId, "2", "cluster 'app10-test-9898' is invalid", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := snapshot.current.Upstreams[newKey]; !ok || len(snapshot.rollback.rejected) != 0 {
+		t.Errorf("Got upstream %v rejected before the clusters were acked", newKey)
+	}
+
+	// test that the rejection is attributed once it repeats after the clusters are acked
+	err = snapshot.Reject(nodeId, "2", "cluster 'app10-test-9898' is invalid", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := snapshot.current.Upstreams[newKey]; ok {
+		t.Errorf("Got upstream %v wanted none", newKey)
+	}
+}
@@ -0,0 +1,45 @@
+package envoy
+
+import (
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+)
+
+// Certificate is a compact form of an Envoy TLS certificate secret
+type Certificate struct {
+	Name  string `json:"name"`
+	Chain []byte `json:"-"`
+	Key   []byte `json:"-"`
+}
+
+func newSecret(cert Certificate) *tls.Secret {
+	return &tls.Secret{
+		Name: cert.Name,
+		Type: &tls.Secret_TlsCertificate{
+			TlsCertificate: &tls.TlsCertificate{
+				CertificateChain: &envoycore.DataSource{
+					Specifier: &envoycore.DataSource_InlineBytes{InlineBytes: cert.Chain},
+				},
+				PrivateKey: &envoycore.DataSource{
+					Specifier: &envoycore.DataSource_InlineBytes{InlineBytes: cert.Key},
+				},
+			},
+		},
+	}
+}
+
+func newSdsSecretConfig(name string) *tls.SdsSecretConfig {
+	return &tls.SdsSecretConfig{
+		Name:      name,
+		SdsConfig: newAdsConfigSource(),
+	}
+}
+
+func newAdsConfigSource() *envoycore.ConfigSource {
+	return &envoycore.ConfigSource{
+		ResourceApiVersion: envoycore.ApiVersion_V3,
+		ConfigSourceSpecifier: &envoycore.ConfigSource_Ads{
+			Ads: &envoycore.AggregatedConfigSource{},
+		},
+	}
+}
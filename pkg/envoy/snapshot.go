@@ -1,32 +1,61 @@
 package envoy
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
-	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/mitchellh/hashstructure"
 	"k8s.io/klog"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/metrics"
 )
 
-// Snapshot manages Envoy clusters and listeners cache snapshots
+// Snapshot manages Envoy clusters, endpoints, routes, listeners and secrets cache snapshots
 type Snapshot struct {
-	version   uint64
-	cache     cache.SnapshotCache
-	upstreams *sync.Map
-	checksum  uint64
-	nodeId    string
+	version      uint64
+	cache        cache.SnapshotCache
+	upstreams    *sync.Map
+	certificates *sync.Map
+	endpoints    *sync.Map
+	checksum     uint64
+	current      state
+	rollback     *rollback
+	conflicts    []Conflict
+	changes      map[string]change
+	mu           sync.Mutex
+}
+
+// state holds the upstreams, certificates and endpoints of the last sync
+type state struct {
+	Upstreams    map[string]Upstream
+	Certificates map[string]Certificate
+	Endpoints    map[string][]Endpoint
+}
+
+// change holds the resource types that changed in the last version of a node group
+type change struct {
+	version string
+	types   []string
 }
 
 // NewSnapshot creates an Envoy cache snapshot manager
 func NewSnapshot(cache cache.SnapshotCache) *Snapshot {
 	return &Snapshot{
-		version:   0,
-		cache:     cache,
-		upstreams: new(sync.Map),
+		version:      0,
+		cache:        cache,
+		upstreams:    new(sync.Map),
+		certificates: new(sync.Map),
+		endpoints:    new(sync.Map),
+		rollback:     newRollback(),
+		changes:      make(map[string]change),
 	}
 }
 
@@ -35,11 +64,40 @@ func (s *Snapshot) Store(key string, value Upstream) {
 	s.upstreams.Store(key, value)
 }
 
+// Load returns an upstream from the in-memory cache
+func (s *Snapshot) Load(key string) (Upstream, bool) {
+	value, ok := s.upstreams.Load(key)
+	if !ok {
+		return Upstream{}, false
+	}
+	return value.(Upstream), true
+}
+
 // Delete removes an upstream from the in-memory cache
 func (s *Snapshot) Delete(key string) {
 	s.upstreams.Delete(key)
 }
 
+// StoreCertificate inserts or updates a TLS certificate in the in-memory cache
+func (s *Snapshot) StoreCertificate(key string, value Certificate) {
+	s.certificates.Store(key, value)
+}
+
+// DeleteCertificate removes a TLS certificate from the in-memory cache
+func (s *Snapshot) DeleteCertificate(key string) {
+	s.certificates.Delete(key)
+}
+
+// StoreEndpoints inserts or updates the endpoints of a Kubernetes service in the in-memory cache
+func (s *Snapshot) StoreEndpoints(key string, value []Endpoint) {
+	s.endpoints.Store(key, value)
+}
+
+// DeleteEndpoints removes the endpoints of a Kubernetes service from the in-memory cache
+func (s *Snapshot) DeleteEndpoints(key string) {
+	s.endpoints.Delete(key)
+}
+
 // Len returns the number of upstreams stored in the in-memory cache
 func (s *Snapshot) Len() int {
 	var length int
@@ -50,52 +108,209 @@ func (s *Snapshot) Len() int {
 	return length
 }
 
-func (s *Snapshot) getNodeId() (string, error) {
-	if s.nodeId != "" {
-		return s.nodeId, nil
+// Upstreams returns a copy of the upstreams stored in the in-memory cache
+func (s *Snapshot) Upstreams() map[string]Upstream {
+	upstreams := make(map[string]Upstream)
+	s.upstreams.Range(func(key interface{}, value interface{}) bool {
+		upstreams[key.(string)] = value.(Upstream)
+		return true
+	})
+	return upstreams
+}
+
+// Version returns the version and checksum of the last sync
+func (s *Snapshot) Version() (string, uint64) {
+	return fmt.Sprint(atomic.LoadUint64(&s.version)), atomic.LoadUint64(&s.checksum)
+}
+
+// Cache returns the Envoy cache where the snapshots are set
+func (s *Snapshot) Cache() cache.SnapshotCache {
+	return s.cache
+}
+
+// Synced returns true after the first successful sync
+func (s *Snapshot) Synced() bool {
+	return atomic.LoadUint64(&s.checksum) != 0
+}
+
+// Push sets the current snapshot for a node group that doesn't have it yet,
+// it's a no-op if no snapshot has been built
+func (s *Snapshot) Push(group string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current.Upstreams == nil {
+		return nil
+	}
+
+	version := fmt.Sprint(atomic.LoadUint64(&s.version))
+	if snap, err := s.cache.GetSnapshot(group); err == nil && snap.GetVersion(resource.ListenerType) == version {
+		return nil
+	}
+
+	if err := s.set(group, version); err != nil {
+		return err
 	}
-	if len(s.cache.GetStatusKeys()) < 1 {
-		return "", fmt.Errorf("cache has no node IDs, status keys %d", len(s.cache.GetStatusKeys()))
+
+	klog.Infof("cache pushed to node group %s, version %s", group, version)
+	return nil
+}
+
+// ChangedTypes returns the resource types that changed in the current version of a node group,
+// it returns false if the version is not the current one
+func (s *Snapshot) ChangedTypes(group string, version string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.changes[group]
+	if !ok || c.version != version {
+		return nil, false
 	}
-	return s.cache.GetStatusKeys()[0], nil
+	return append([]string(nil), c.types...), true
+}
+
+// Clear removes the snapshot of a node group that has no connected nodes,
+// so that the next syncs don't build snapshots for it
+func (s *Snapshot) Clear(group string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache.ClearSnapshot(group)
+	delete(s.changes, group)
+	klog.Infof("cache cleared for node group %s", group)
 }
 
 // Sync reconciles the in-memory cache of upstreams
 // with the Envoy cache by creating a new snapshot
+// for each connected node group, the upstreams rejected
+// by Envoy are served with their last accepted version
+// and the domains claimed by more than one upstream are served by the oldest one
 func (s *Snapshot) Sync() error {
-	nodeId, err := s.getNodeId()
-	if err != nil {
-		return err
-	}
-	upstreams := make(map[string]Upstream)
-	var listeners []cache.Resource
-	var clusters []cache.Resource
-	var vhosts []*route.VirtualHost
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	s.upstreams.Range(func(key interface{}, value interface{}) bool {
+	upstreams := s.Upstreams()
+	s.exclude(upstreams)
+	s.conflicts = resolveConflicts(upstreams)
+
+	certificates := make(map[string]Certificate)
+	s.certificates.Range(func(key interface{}, value interface{}) bool {
 		k := key.(string)
-		upstream := value.(Upstream)
-		upstreams[k] = upstream
+		cert := value.(Certificate)
+		certificates[k] = cert
 		return true
 	})
 
-	checksum, err := hashstructure.Hash(upstreams, nil)
+	// only the endpoints of the services referenced by upstreams are part of the state,
+	// so that pod churn in other services doesn't trigger a new snapshot
+	endpoints := make(map[string][]Endpoint)
+	for _, upstream := range upstreams {
+		if value, ok := s.endpoints.Load(upstream.Service); ok && upstream.Service != "" {
+			endpoints[upstream.Service] = value.([]Endpoint)
+		}
+	}
+
+	current := state{
+		Upstreams:    upstreams,
+		Certificates: certificates,
+		Endpoints:    endpoints,
+	}
+
+	checksum, err := hashstructure.Hash(current, nil)
 	if err != nil {
 		return fmt.Errorf("checksum error %v", err)
 	}
 
-	if checksum == s.checksum {
+	if checksum == atomic.LoadUint64(&s.checksum) {
 		return nil
 	}
 
-	for _, upstream := range upstreams {
-		cluster := newCluster(upstream, time.Second)
-		clusters = append(clusters, cluster)
+	for _, conflict := range s.conflicts {
+		klog.Warningf("domain %s of upstream %s dropped, the domain is claimed by %s", conflict.Domain, conflict.Upstream, conflict.Winner)
+	}
+
+	s.current = current
+	versionNumber := atomic.AddUint64(&s.version, 1)
+	version := fmt.Sprint(versionNumber)
+
+	start := time.Now()
+	groups := s.cache.GetStatusKeys()
+	for _, group := range groups {
+		if err := s.set(group, version); err != nil {
+			return err
+		}
+	}
+
+	metrics.SnapshotDuration.Observe(time.Since(start).Seconds())
+	metrics.SnapshotVersion.Set(float64(versionNumber))
+	metrics.Upstreams.Set(float64(len(upstreams)))
+
+	atomic.StoreUint64(&s.checksum, checksum)
+	klog.Infof("cache updated for %d services and %d node groups, version %s, checksum %d", len(upstreams), len(groups), version, checksum)
+
+	return nil
+}
+
+// set builds the snapshot of a node group from the upstreams matching
+// the group class and sets it in the Envoy cache
+func (s *Snapshot) set(group string, version string) error {
+	var listeners []types.Resource
+	var clusters []types.Resource
+	var endpoints []types.Resource
+	var secrets []types.Resource
+	var routes []types.Resource
+	var vhosts []*route.VirtualHost
+	var tlsVhosts []*route.VirtualHost
+	serverNames := make(map[string][]string)
+	claimed := make(map[string]bool)
+
+	var keys []string
+	for key := range s.current.Upstreams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		upstream := s.current.Upstreams[key]
+		if !upstream.MatchClass(group) {
+			continue
+		}
+		eps, eds := s.current.Endpoints[upstream.Service]
+		if eds {
+			eps, eds = upstreamEndpoints(upstream, eps)
+		}
+		if eds {
+			clusters = append(clusters, newEDSCluster(upstream, time.Second))
+			endpoints = append(endpoints, newLoadAssignment(upstream, eps))
+		} else {
+			clusters = append(clusters, newCluster(upstream, time.Second))
+		}
+		// the plaintext requests are redirected only if the upstream is served on the HTTPS listener
+		_, hasCertificate := s.current.Certificates[upstream.TLSSecret]
+		tls := hasCertificate && len(upstream.ServerNames()) > 0
+
 		vh := newVirtualHost(upstream)
-		vhosts = append(vhosts, &vh)
+		if upstream.HTTPSRedirect && tls {
+			rvh := newRedirectVirtualHost(upstream)
+			vhosts = append(vhosts, &rvh)
+		} else {
+			vhosts = append(vhosts, &vh)
+		}
+
+		if tls {
+			tlsVhosts = append(tlsVhosts, &vh)
+			for _, name := range upstream.ServerNames() {
+				if !claimed[name] {
+					claimed[name] = true
+					serverNames[upstream.TLSSecret] = append(serverNames[upstream.TLSSecret], name)
+				}
+			}
+		}
 	}
 
-	cm := newConnectionManager("local_route", vhosts, 5*time.Second)
+	routes = append(routes, newRouteConfiguration("local_route", vhosts))
+	cm, err := newConnectionManager("local_route", "ingress_http", 5*time.Second)
+	if err != nil {
+		return err
+	}
 	httpListener, err := newListener("listener_http", "0.0.0.0", 8080, cm)
 	if err != nil {
 		return err
@@ -103,20 +318,102 @@ func (s *Snapshot) Sync() error {
 
 	listeners = append(listeners, httpListener)
 
-	atomic.AddUint64(&s.version, 1)
-	snapshot := cache.NewSnapshot(fmt.Sprint(s.version), nil, clusters, nil, listeners)
+	if len(serverNames) > 0 {
+		for name := range serverNames {
+			secrets = append(secrets, newSecret(s.current.Certificates[name]))
+		}
+
+		routes = append(routes, newRouteConfiguration("local_route_https", tlsVhosts))
+		tlsCm, err := newConnectionManager("local_route_https", "ingress_https", 5*time.Second)
+		if err != nil {
+			return err
+		}
+		httpsListener, err := newTLSListener("listener_https", "0.0.0.0", 8443, tlsCm, serverNames)
+		if err != nil {
+			return err
+		}
+
+		listeners = append(listeners, httpsListener)
+	}
+
+	snapshot, err := cache.NewSnapshot(version, map[resource.Type][]types.Resource{
+		resource.ClusterType:  clusters,
+		resource.EndpointType: endpoints,
+		resource.RouteType:    routes,
+		resource.ListenerType: listeners,
+		resource.SecretType:   secrets,
+	})
+	if err != nil {
+		return err
+	}
 
 	if err := snapshot.Consistent(); err != nil {
 		return err
 	}
 
-	err = s.cache.SetSnapshot(nodeId, snapshot)
+	// compute the per-resource versions used by incremental xDS
+	// to send only the resources that changed since the last snapshot
+	if err := snapshot.ConstructVersionMap(); err != nil {
+		return fmt.Errorf("error while computing resource versions for node group %s %v", group, err)
+	}
+
+	// record the types that changed so that a version is accepted only after Envoy acks all of them
+	changed := make(map[string]bool)
+	prev, prevErr := s.cache.GetSnapshot(group)
+	for _, typeURL := range []string{resource.ClusterType, resource.EndpointType, resource.RouteType, resource.ListenerType, resource.SecretType} {
+		if prevErr != nil {
+			changed[typeURL] = len(snapshot.GetResources(typeURL)) > 0
+		} else {
+			changed[typeURL] = changedResources(prev, snapshot, typeURL) > 0
+		}
+	}
+
+	if prevErr == nil {
+		klog.V(4).Infof("node group %s version %s changed clusters %d endpoints %d routes %d listeners %d secrets %d", group, version,
+			changedResources(prev, snapshot, resource.ClusterType),
+			changedResources(prev, snapshot, resource.EndpointType),
+			changedResources(prev, snapshot, resource.RouteType),
+			changedResources(prev, snapshot, resource.ListenerType),
+			changedResources(prev, snapshot, resource.SecretType))
+	}
+
+	err = s.cache.SetSnapshot(context.Background(), group, snapshot)
 	if err != nil {
-		return fmt.Errorf("error while setting snapshot %v", err)
+		return fmt.Errorf("error while setting snapshot for node group %s %v", group, err)
 	}
 
-	atomic.StoreUint64(&s.checksum, checksum)
-	klog.Infof("cache updated for %d services, version %d, checksum %d", len(upstreams), s.version, checksum)
+	var types []string
+	for typeURL, ok := range changed {
+		if ok {
+			types = append(types, typeURL)
+		}
+	}
+	sort.Strings(types)
+	s.changes[group] = change{version: version, types: types}
 
 	return nil
 }
+
+// changedResources returns the number of resources of a type
+// that were added, updated or removed between two snapshots
+func changedResources(prev cache.ResourceSnapshot, next cache.ResourceSnapshot, typeURL string) int {
+	if err := prev.ConstructVersionMap(); err != nil {
+		return len(next.GetVersionMap(typeURL))
+	}
+
+	prevVersions := prev.GetVersionMap(typeURL)
+	nextVersions := next.GetVersionMap(typeURL)
+
+	var changed int
+	for name, version := range nextVersions {
+		if prevVersions[name] != version {
+			changed++
+		}
+	}
+	for name := range prevVersions {
+		if _, ok := nextVersions[name]; !ok {
+			changed++
+		}
+	}
+	return changed
+}
@@ -4,6 +4,13 @@ import (
 	"fmt"
 	"testing"
 	"time"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
 )
 
 func mockUpstream(i int, prefix string) (string, Upstream) {
@@ -34,10 +41,22 @@ func mockUpstreams(prefix string) map[string]Upstream {
 	return m
 }
 
+func mockNode(c cache.SnapshotCache, nodeId string) {
+	mockClusterNode(c, nodeId, "")
+}
+
+func mockClusterNode(c cache.SnapshotCache, nodeId string, cluster string) {
+	c.CreateWatch(&discovery.DiscoveryRequest{
+		Node:    &envoycore.Node{Id: nodeId, Cluster: cluster},
+		TypeUrl: resource.ListenerType,
+	}, stream.NewStreamState(false, nil), make(chan cache.Response, 1))
+}
+
 func TestSnapshot_Sync(t *testing.T) {
-	cache := NewCache(true)
+	cache := NewCache(true, Hasher{})
 	snapshot := NewSnapshot(cache)
-	snapshot.nodeId = "test"
+	nodeId := "test"
+	mockNode(cache, nodeId)
 
 	// test init
 	i := 0
@@ -54,17 +73,17 @@ func TestSnapshot_Sync(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 
-	snap, err := snapshot.cache.GetSnapshot(snapshot.nodeId)
+	snap, err := snapshot.cache.GetSnapshot(nodeId)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	if len(snap.Clusters.Items) != 5 {
-		t.Errorf("Got clusters %v wanted %v", len(snap.Clusters.Items), 5)
+	if len(snap.GetResources(resource.ClusterType)) != 5 {
+		t.Errorf("Got clusters %v wanted %v", len(snap.GetResources(resource.ClusterType)), 5)
 	}
 
-	if snap.Listeners.Version != "1" {
-		t.Errorf("Got version %v wanted %v", snap.Listeners.Version, "1")
+	if snap.GetVersion(resource.ListenerType) != "1" {
+		t.Errorf("Got version %v wanted %v", snap.GetVersion(resource.ListenerType), "1")
 	}
 
 	// test insert
@@ -77,17 +96,17 @@ func TestSnapshot_Sync(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 
-	snap, err = snapshot.cache.GetSnapshot(snapshot.nodeId)
+	snap, err = snapshot.cache.GetSnapshot(nodeId)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	if len(snap.Clusters.Items) != 10 {
-		t.Errorf("Got clusters %v wanted %v", len(snap.Clusters.Items), 10)
+	if len(snap.GetResources(resource.ClusterType)) != 10 {
+		t.Errorf("Got clusters %v wanted %v", len(snap.GetResources(resource.ClusterType)), 10)
 	}
 
-	if snap.Listeners.Version != "2" {
-		t.Errorf("Got version %v wanted %v", snap.Listeners.Version, "2")
+	if snap.GetVersion(resource.ListenerType) != "2" {
+		t.Errorf("Got version %v wanted %v", snap.GetVersion(resource.ListenerType), "2")
 	}
 
 	// test update
@@ -101,17 +120,17 @@ func TestSnapshot_Sync(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 
-	snap, err = snapshot.cache.GetSnapshot(snapshot.nodeId)
+	snap, err = snapshot.cache.GetSnapshot(nodeId)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	if len(snap.Clusters.Items) != 10 {
-		t.Errorf("Got clusters %v wanted %v", len(snap.Clusters.Items), 10)
+	if len(snap.GetResources(resource.ClusterType)) != 10 {
+		t.Errorf("Got clusters %v wanted %v", len(snap.GetResources(resource.ClusterType)), 10)
 	}
 
-	if snap.Listeners.Version != "3" {
-		t.Errorf("Got version %v wanted %v", snap.Listeners.Version, "3")
+	if snap.GetVersion(resource.ListenerType) != "3" {
+		t.Errorf("Got version %v wanted %v", snap.GetVersion(resource.ListenerType), "3")
 	}
 
 	// test delete
@@ -124,16 +143,437 @@ func TestSnapshot_Sync(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 
-	snap, err = snapshot.cache.GetSnapshot(snapshot.nodeId)
+	snap, err = snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snap.GetResources(resource.ClusterType)) != 0 {
+		t.Errorf("Got clusters %v wanted %v", len(snap.GetResources(resource.ClusterType)), 0)
+	}
+
+	if snap.GetVersion(resource.ListenerType) != "4" {
+		t.Errorf("Got version %v wanted %v", snap.GetVersion(resource.ListenerType), "4")
+	}
+}
+
+func TestSnapshot_SyncNodes(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodes := []string{"envoy-0", "envoy-1"}
+	for _, nodeId := range nodes {
+		mockNode(cache, nodeId)
+	}
+
+	for key, value := range mockUpstreams("/") {
+		snapshot.Store(key, value)
+	}
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, nodeId := range nodes {
+		snap, err := snapshot.cache.GetSnapshot(nodeId)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(snap.GetResources(resource.ClusterType)) != 10 {
+			t.Errorf("Got clusters %v wanted %v for node %s", len(snap.GetResources(resource.ClusterType)), 10, nodeId)
+		}
+	}
+
+	// test push to a node that connected after sync
+	err = snapshot.Push("envoy-2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snap, err := snapshot.cache.GetSnapshot("envoy-2")
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	if len(snap.Clusters.Items) != 0 {
-		t.Errorf("Got clusters %v wanted %v", len(snap.Clusters.Items), 0)
+	if snap.GetVersion(resource.ListenerType) != "1" {
+		t.Errorf("Got version %v wanted %v", snap.GetVersion(resource.ListenerType), "1")
+	}
+}
+
+func TestSnapshot_SyncBeforeConnect(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+
+	for key, value := range mockUpstreams("/") {
+		snapshot.Store(key, value)
+	}
+
+	// test sync without connected nodes
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !snapshot.Synced() {
+		t.Errorf("Got synced %v wanted %v", snapshot.Synced(), true)
+	}
+
+	// test push on first request
+	nodeId := "test"
+	err = snapshot.Push(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mockNode(cache, nodeId)
+
+	snap, err := snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snap.GetResources(resource.ClusterType)) != 10 {
+		t.Errorf("Got clusters %v wanted %v", len(snap.GetResources(resource.ClusterType)), 10)
+	}
+
+	if snap.GetVersion(resource.ListenerType) != "1" {
+		t.Errorf("Got version %v wanted %v", snap.GetVersion(resource.ListenerType), "1")
+	}
+}
+
+func TestSnapshot_SyncGroups(t *testing.T) {
+	cache := NewCache(true, Hasher{GroupBy: GroupByCluster})
+	snapshot := NewSnapshot(cache)
+	mockClusterNode(cache, "envoy-0", "internal")
+	mockClusterNode(cache, "envoy-1", "internal")
+	mockClusterNode(cache, "envoy-2", "public")
+
+	for key, value := range mockUpstreams("/") {
+		snapshot.Store(key, value)
+	}
+	for i := 0; i < 3; i++ {
+		k, u := mockUpstream(i, "/")
+		u.Class = "public"
+		snapshot.Store(k, u)
+	}
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snapshot.cache.GetStatusKeys()) != 2 {
+		t.Errorf("Got node groups %v wanted %v", len(snapshot.cache.GetStatusKeys()), 2)
+	}
+
+	snap, err := snapshot.cache.GetSnapshot("internal")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snap.GetResources(resource.ClusterType)) != 7 {
+		t.Errorf("Got clusters %v wanted %v", len(snap.GetResources(resource.ClusterType)), 7)
+	}
+
+	snap, err = snapshot.cache.GetSnapshot("public")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snap.GetResources(resource.ClusterType)) != 10 {
+		t.Errorf("Got clusters %v wanted %v", len(snap.GetResources(resource.ClusterType)), 10)
+	}
+}
+
+func TestSnapshot_SyncTLS(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodeId := "test"
+	mockNode(cache, nodeId)
+
+	for key, value := range mockUpstreams("/") {
+		snapshot.Store(key, value)
+	}
+	k, u := mockUpstream(0, "/")
+	u.TLSSecret = "test/app0-tls"
+	snapshot.Store(k, u)
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snap, err := snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snap.GetResources(resource.ListenerType)) != 1 {
+		t.Errorf("Got listeners %v wanted %v without certificate", len(snap.GetResources(resource.ListenerType)), 1)
+	}
+
+	snapshot.StoreCertificate("test/app0-tls", Certificate{
+		Name:  "test/app0-tls",
+		Chain: []byte("chain"),
+		Key:   []byte("key"),
+	})
+
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snap, err = snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snap.GetResources(resource.ListenerType)) != 2 {
+		t.Errorf("Got listeners %v wanted %v", len(snap.GetResources(resource.ListenerType)), 2)
+	}
+
+	if len(snap.GetResources(resource.SecretType)) != 1 {
+		t.Errorf("Got secrets %v wanted %v", len(snap.GetResources(resource.SecretType)), 1)
+	}
+
+	if snap.GetVersion(resource.SecretType) != "2" {
+		t.Errorf("Got version %v wanted %v", snap.GetVersion(resource.SecretType), "2")
+	}
+}
+
+func TestSnapshot_SyncVersionMap(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodeId := "test"
+	mockNode(cache, nodeId)
+
+	for key, value := range mockUpstreams("/") {
+		snapshot.Store(key, value)
+	}
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	prev, err := snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(prev.GetVersionMap(resource.ClusterType)) != 10 {
+		t.Errorf("Got cluster versions %v wanted %v", len(prev.GetVersionMap(resource.ClusterType)), 10)
+	}
+
+	// test update of a single upstream
+	k, u := mockUpstream(0, "/")
+	u.Port = 8080
+	snapshot.Store(k, u)
+
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	next, err := snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if changed := changedResources(prev, next, resource.ClusterType); changed != 1 {
+		t.Errorf("Got changed clusters %v wanted %v", changed, 1)
+	}
+}
+
+func TestSnapshot_SyncRoutes(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodeId := "test"
+	mockNode(cache, nodeId)
+
+	for key, value := range mockUpstreams("/") {
+		snapshot.Store(key, value)
+	}
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	prev, err := snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(prev.GetResources(resource.RouteType)) != 1 {
+		t.Errorf("Got routes %v wanted %v", len(prev.GetResources(resource.RouteType)), 1)
+	}
+
+	// test that the clusters are not validated since RDS and CDS are not ordered
+	for _, res := range prev.GetResources(resource.RouteType) {
+		if rc := res.(*route.RouteConfiguration); rc.GetValidateClusters() != nil {
+			t.Errorf("Got validate clusters %v wanted unset", rc.GetValidateClusters())
+		}
+	}
+
+	// test canary weight change
+	k, u := mockUpstream(0, "/")
+	u.Canary.CanaryWeight = 10
+	snapshot.Store(k, u)
+
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	next, err := snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if changed := changedResources(prev, next, resource.RouteType); changed != 1 {
+		t.Errorf("Got changed routes %v wanted %v", changed, 1)
+	}
+
+	if changed := changedResources(prev, next, resource.ListenerType); changed != 0 {
+		t.Errorf("Got changed listeners %v wanted %v", changed, 0)
+	}
+}
+
+func TestSnapshot_SyncEndpoints(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodeId := "test"
+	mockNode(cache, nodeId)
+
+	for key, value := range mockUpstreams("/") {
+		value.Service = key
+		snapshot.Store(key, value)
+	}
+
+	// test endpoints of a single service
+	snapshot.StoreEndpoints("test/app0", []Endpoint{
+		{Address: "10.0.0.1", Port: 9898},
+		{Address: "10.0.0.2", Port: 9898},
+	})
+
+	// test endpoints of an unreferenced service
+	snapshot.StoreEndpoints("test/other", []Endpoint{{Address: "10.0.0.3", Port: 9898}})
+
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snap, err := snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snap.GetResources(resource.ClusterType)) != 10 {
+		t.Errorf("Got clusters %v wanted %v", len(snap.GetResources(resource.ClusterType)), 10)
+	}
+
+	if len(snap.GetResources(resource.EndpointType)) != 1 {
+		t.Errorf("Got endpoints %v wanted %v", len(snap.GetResources(resource.EndpointType)), 1)
+	}
+
+	// test unreferenced endpoints update
+	snapshot.StoreEndpoints("test/other", nil)
+
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snap, err = snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if snap.GetVersion(resource.EndpointType) != "1" {
+		t.Errorf("Got version %v wanted %v", snap.GetVersion(resource.EndpointType), "1")
+	}
+
+	// test pod churn
+	snapshot.StoreEndpoints("test/app0", []Endpoint{{Address: "10.0.0.1", Port: 9898}})
+
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	next, err := snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if changed := changedResources(snap, next, resource.EndpointType); changed != 1 {
+		t.Errorf("Got changed endpoints %v wanted %v", changed, 1)
+	}
+
+	if changed := changedResources(snap, next, resource.ClusterType); changed != 0 {
+		t.Errorf("Got changed clusters %v wanted %v", changed, 0)
+	}
+}
+
+func TestSnapshot_SyncHTTPSRedirect(t *testing.T) {
+	cache := NewCache(true, Hasher{})
+	snapshot := NewSnapshot(cache)
+	nodeId := "test"
+	mockNode(cache, nodeId)
+
+	k, u := mockUpstream(0, "/")
+	u.TLSSecret = "test/app0-tls"
+	u.HTTPSRedirect = true
+	snapshot.Store(k, u)
+
+	redirects := func() int {
+		snap, err := snapshot.cache.GetSnapshot(nodeId)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var count int
+		res := snap.GetResources(resource.RouteType)["local_route"].(*route.RouteConfiguration)
+		for _, vh := range res.VirtualHosts {
+			for _, r := range vh.Routes {
+				if r.GetRedirect() != nil {
+					count++
+				}
+			}
+		}
+		return count
+	}
+
+	// test that the upstream is not redirected without a certificate
+	err := snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snap, err := snapshot.cache.GetSnapshot(nodeId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(snap.GetResources(resource.ListenerType)) != 1 {
+		t.Errorf("Got listeners %v wanted %v", len(snap.GetResources(resource.ListenerType)), 1)
+	}
+	if n := redirects(); n != 0 {
+		t.Errorf("Got redirects %v wanted %v without certificate", n, 0)
+	}
+
+	snapshot.StoreCertificate("test/app0-tls", Certificate{
+		Name:  "test/app0-tls",
+		Chain: []byte("chain"),
+		Key:   []byte("key"),
+	})
+
+	err = snapshot.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
 	}
 
-	if snap.Listeners.Version != "4" {
-		t.Errorf("Got version %v wanted %v", snap.Listeners.Version, "4")
+	if n := redirects(); n != 1 {
+		t.Errorf("Got redirects %v wanted %v", n, 1)
 	}
 }
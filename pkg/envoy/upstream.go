@@ -1,25 +1,84 @@
 package envoy
 
 import (
+	"strings"
 	"time"
 )
 
 // Upstream is a compact form of an Envoy cluster and virtual host
 type Upstream struct {
-	Name     string        `json:"name"`
-	Host     string        `json:"host"`
-	Port     uint32        `json:"port"`
-	PortName string        `json:"portName"`
-	Domains  []string      `json:"domains"`
-	Prefix   string        `json:"prefix"`
-	Retries  uint32        `json:"retries"`
-	Timeout  time.Duration `json:"timeout"`
-	Canary   *Canary       `json:"canary"`
+	Name          string        `json:"name"`
+	Host          string        `json:"host"`
+	Port          uint32        `json:"port"`
+	PortName      string        `json:"portName"`
+	Domains       []string      `json:"domains"`
+	Prefix        string        `json:"prefix"`
+	Retries       uint32        `json:"retries"`
+	Timeout       time.Duration `json:"timeout"`
+	Canary        *Canary       `json:"canary"`
+	Class         string        `json:"class"`
+	TLSSecret     string        `json:"tlsSecret"`
+	HTTPSRedirect bool          `json:"httpsRedirect"`
+	Service       string        `json:"service"`
+	Created       time.Time     `json:"created" hash:"ignore"`
 }
 
-// Canary is a compact form of an Envoy weighted cluster
+// MatchClass checks if the upstream should be served to an Envoy node group,
+// upstreams without a class are served to all groups
+func (u Upstream) MatchClass(group string) bool {
+	return u.Class == "" || u.Class == group
+}
+
+// ConflictingDomains returns the domains claimed by both upstreams
+// when they can be served to the same Envoy node group
+func (u Upstream) ConflictingDomains(other Upstream) []string {
+	if !u.overlaps(other) {
+		return nil
+	}
+	var domains []string
+	for _, domain := range u.Domains {
+		for _, otherDomain := range other.Domains {
+			if domain == otherDomain {
+				domains = append(domains, domain)
+			}
+		}
+	}
+	return domains
+}
+
+// overlaps checks if the upstreams can be served to the same Envoy node group
+func (u Upstream) overlaps(other Upstream) bool {
+	return u.Class == "" || other.Class == "" || u.Class == other.Class
+}
+
+// ServerNames returns the upstream domains that can be matched by SNI
+func (u Upstream) ServerNames() []string {
+	var names []string
+	for _, domain := range u.Domains {
+		if !strings.Contains(domain, ":") {
+			names = append(names, domain)
+		}
+	}
+	return names
+}
+
+// Canary is a compact form of an Envoy weighted cluster,
+// in mirror mode the primary receives all the traffic and
+// the canary weight percentage is shadowed to the canary cluster,
+// the requests matching any of the header matches are sent to the canary cluster
 type Canary struct {
-	PrimaryCluster string `json:"primaryCluster"`
-	CanaryCluster  string `json:"canaryCluster"`
-	CanaryWeight   int    `json:"canaryWeight"`
+	PrimaryCluster string        `json:"primaryCluster"`
+	CanaryCluster  string        `json:"canaryCluster"`
+	CanaryWeight   int           `json:"canaryWeight"`
+	Match          []HeaderMatch `json:"match,omitempty"`
+	Mirror         bool          `json:"mirror"`
+}
+
+// HeaderMatch is a compact form of an Envoy header matcher,
+// when no match type is set the header presence is checked
+type HeaderMatch struct {
+	Name   string `json:"name"`
+	Exact  string `json:"exact,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Regex  string `json:"regex,omitempty"`
 }
@@ -4,47 +4,88 @@ import (
 	"fmt"
 	"time"
 
-	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
-	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
-	"github.com/golang/protobuf/ptypes"
-	"github.com/golang/protobuf/ptypes/wrappers"
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	previoushosts "github.com/envoyproxy/go-control-plane/envoy/extensions/retry/host/previous_hosts/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
+// newRouteConfiguration creates a route configuration served over RDS,
+// the clusters are not validated since Envoy can receive the routes before the clusters
+func newRouteConfiguration(name string, vhosts []*route.VirtualHost) *route.RouteConfiguration {
+	return &route.RouteConfiguration{
+		Name:         name,
+		VirtualHosts: vhosts,
+	}
+}
+
 func newVirtualHost(upstream Upstream) route.VirtualHost {
 	action := &route.RouteAction{
-		HostRewriteSpecifier: &route.RouteAction_HostRewrite{
-			HostRewrite: upstream.Host,
+		HostRewriteSpecifier: &route.RouteAction_HostRewriteLiteral{
+			HostRewriteLiteral: upstream.Host,
 		},
 		ClusterSpecifier: &route.RouteAction_Cluster{
 			Cluster: upstream.Name,
 		},
-		Timeout: ptypes.DurationProto(upstream.Timeout),
+		Timeout: durationpb.New(upstream.Timeout),
 	}
 
+	var routes []*route.Route
 	if upstream.Canary != nil && upstream.Canary.CanaryCluster != "" && upstream.Canary.PrimaryCluster != "" {
 		action = &route.RouteAction{
-			HostRewriteSpecifier: &route.RouteAction_HostRewrite{
-				HostRewrite: upstream.Host,
+			HostRewriteSpecifier: &route.RouteAction_HostRewriteLiteral{
+				HostRewriteLiteral: upstream.Host,
 			},
 			ClusterSpecifier: &route.RouteAction_WeightedClusters{
 				WeightedClusters: &route.WeightedCluster{
 					Clusters: []*route.WeightedCluster_ClusterWeight{
 						{
 							Name:   upstream.Canary.CanaryCluster,
-							Weight: &wrappers.UInt32Value{Value: uint32(upstream.Canary.CanaryWeight)},
+							Weight: &wrapperspb.UInt32Value{Value: uint32(upstream.Canary.CanaryWeight)},
 						},
 						{
 							Name:   upstream.Canary.PrimaryCluster,
-							Weight: &wrappers.UInt32Value{Value: uint32(100 - upstream.Canary.CanaryWeight)},
+							Weight: &wrapperspb.UInt32Value{Value: uint32(100 - upstream.Canary.CanaryWeight)},
 						},
 					},
 				},
 			},
-			Timeout: ptypes.DurationProto(upstream.Timeout),
+			Timeout: durationpb.New(upstream.Timeout),
+		}
+
+		if upstream.Canary.Mirror {
+			action = &route.RouteAction{
+				HostRewriteSpecifier: &route.RouteAction_HostRewriteLiteral{
+					HostRewriteLiteral: upstream.Host,
+				},
+				ClusterSpecifier: &route.RouteAction_Cluster{
+					Cluster: upstream.Canary.PrimaryCluster,
+				},
+				RequestMirrorPolicies: []*route.RouteAction_RequestMirrorPolicy{{
+					Cluster: upstream.Canary.CanaryCluster,
+					RuntimeFraction: &envoycore.RuntimeFractionalPercent{
+						DefaultValue: &envoytype.FractionalPercent{
+							Numerator:   uint32(upstream.Canary.CanaryWeight),
+							Denominator: envoytype.FractionalPercent_HUNDRED,
+						},
+					},
+				}},
+				Timeout: durationpb.New(upstream.Timeout),
+			}
+		}
+
+		// Envoy ANDs the headers of a route, so each match gets its own route
+		// and a request matching any of them is sent to the canary
+		for _, match := range upstream.Canary.Match {
+			routes = append(routes, newCanaryMatchRoute(upstream, match))
 		}
 	}
 
-	r := &route.Route{
+	routes = append(routes, &route.Route{
 		Match: &route.RouteMatch{
 			PathSpecifier: &route.RouteMatch_Prefix{
 				Prefix: upstream.Prefix,
@@ -53,12 +94,12 @@ func newVirtualHost(upstream Upstream) route.VirtualHost {
 		Action: &route.Route_Route{
 			Route: action,
 		},
-	}
+	})
 
 	return route.VirtualHost{
 		Name:        upstream.Name,
 		Domains:     upstream.Domains,
-		Routes:      []*route.Route{r},
+		Routes:      routes,
 		RetryPolicy: makeRetryPolicy(upstream.Retries, upstream.Timeout),
 		RequestHeadersToAdd: []*envoycore.HeaderValueOption{
 			{
@@ -72,15 +113,89 @@ func newVirtualHost(upstream Upstream) route.VirtualHost {
 	}
 }
 
+// newCanaryMatchRoute creates a route that sends the requests
+// matching a canary header to the canary cluster
+func newCanaryMatchRoute(upstream Upstream, match HeaderMatch) *route.Route {
+	return &route.Route{
+		Match: &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{
+				Prefix: upstream.Prefix,
+			},
+			Headers: []*route.HeaderMatcher{newHeaderMatcher(match)},
+		},
+		Action: &route.Route_Route{
+			Route: &route.RouteAction{
+				HostRewriteSpecifier: &route.RouteAction_HostRewriteLiteral{
+					HostRewriteLiteral: upstream.Host,
+				},
+				ClusterSpecifier: &route.RouteAction_Cluster{
+					Cluster: upstream.Canary.CanaryCluster,
+				},
+				Timeout: durationpb.New(upstream.Timeout),
+			},
+		},
+	}
+}
+
+func newHeaderMatcher(match HeaderMatch) *route.HeaderMatcher {
+	hm := &route.HeaderMatcher{
+		Name: match.Name,
+	}
+	switch {
+	case match.Exact != "":
+		hm.HeaderMatchSpecifier = &route.HeaderMatcher_ExactMatch{ExactMatch: match.Exact}
+	case match.Prefix != "":
+		hm.HeaderMatchSpecifier = &route.HeaderMatcher_PrefixMatch{PrefixMatch: match.Prefix}
+	case match.Regex != "":
+		hm.HeaderMatchSpecifier = &route.HeaderMatcher_SafeRegexMatch{
+			SafeRegexMatch: &matcher.RegexMatcher{
+				EngineType: &matcher.RegexMatcher_GoogleRe2{GoogleRe2: &matcher.RegexMatcher_GoogleRE2{}},
+				Regex:      match.Regex,
+			},
+		}
+	default:
+		hm.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+	}
+	return hm
+}
+
+// newRedirectVirtualHost creates a virtual host that redirects plaintext requests to HTTPS
+func newRedirectVirtualHost(upstream Upstream) route.VirtualHost {
+	r := &route.Route{
+		Match: &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{
+				Prefix: upstream.Prefix,
+			},
+		},
+		Action: &route.Route_Redirect{
+			Redirect: &route.RedirectAction{
+				SchemeRewriteSpecifier: &route.RedirectAction_HttpsRedirect{
+					HttpsRedirect: true,
+				},
+			},
+		},
+	}
+
+	return route.VirtualHost{
+		Name:    upstream.Name,
+		Domains: upstream.Domains,
+		Routes:  []*route.Route{r},
+	}
+}
+
 func makeRetryPolicy(retries uint32, timeout time.Duration) *route.RetryPolicy {
+	predicateAny, _ := anypb.New(&previoushosts.PreviousHostsPredicate{})
 	return &route.RetryPolicy{
 		RetryOn:                       "connect-failure,refused-stream,unavailable,cancelled,resource-exhausted,retriable-status-codes",
-		PerTryTimeout:                 ptypes.DurationProto(timeout),
-		NumRetries:                    &wrappers.UInt32Value{Value: retries},
+		PerTryTimeout:                 durationpb.New(timeout),
+		NumRetries:                    &wrapperspb.UInt32Value{Value: retries},
 		HostSelectionRetryMaxAttempts: 5,
 		RetriableStatusCodes:          []uint32{503},
-		RetryHostPredicate: []*route.RetryPolicy_RetryHostPredicate{
-			{Name: "envoy.retry_host_predicates.previous_hosts"},
-		},
+		RetryHostPredicate: []*route.RetryPolicy_RetryHostPredicate{{
+			Name: "envoy.retry_host_predicates.previous_hosts",
+			ConfigType: &route.RetryPolicy_RetryHostPredicate_TypedConfig{
+				TypedConfig: predicateAny,
+			},
+		}},
 	}
 }
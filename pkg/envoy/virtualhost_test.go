@@ -0,0 +1,114 @@
+package envoy
+
+import (
+	"testing"
+
+	"github.com/mitchellh/hashstructure"
+)
+
+func TestNewVirtualHost_CanaryMatch(t *testing.T) {
+	_, upstream := mockUpstream(0, "/")
+	upstream.Canary, _ = CanaryFromAnnotations(map[string]string{
+		GatewayPrimary:      upstream.Canary.PrimaryCluster,
+		GatewayCanary:       upstream.Canary.CanaryCluster,
+		GatewayCanaryWeight: "10",
+		GatewayCanaryMatch:  `[{"name":"x-canary","exact":"insider"},{"name":"user-agent","regex":".*Firefox.*"}]`,
+		GatewayCanaryCookie: "canary",
+	})
+
+	if len(upstream.Canary.Match) != 3 {
+		t.Fatalf("Got matches %v wanted %v", len(upstream.Canary.Match), 3)
+	}
+
+	vh := newVirtualHost(upstream)
+	if len(vh.Routes) != 4 {
+		t.Fatalf("Got routes %v wanted %v", len(vh.Routes), 4)
+	}
+
+	// test that each match has its own route in the annotation order followed by the cookie
+	for i, name := range []string{"x-canary", "user-agent", "cookie"} {
+		matchRoute := vh.Routes[i]
+		if len(matchRoute.Match.Headers) != 1 {
+			t.Fatalf("Got headers %v wanted %v", len(matchRoute.Match.Headers), 1)
+		}
+		if header := matchRoute.Match.Headers[0].Name; header != name {
+			t.Errorf("Got header %v wanted %v", header, name)
+		}
+		if cluster := matchRoute.GetRoute().GetCluster(); cluster != upstream.Canary.CanaryCluster {
+			t.Errorf("Got cluster %v wanted %v", cluster, upstream.Canary.CanaryCluster)
+		}
+	}
+	if exact := vh.Routes[0].Match.Headers[0].GetExactMatch(); exact != "insider" {
+		t.Errorf("Got exact match %v wanted %v", exact, "insider")
+	}
+
+	weightedRoute := vh.Routes[3]
+	if len(weightedRoute.Match.Headers) != 0 {
+		t.Errorf("Got headers %v wanted %v", len(weightedRoute.Match.Headers), 0)
+	}
+	if weightedRoute.GetRoute().GetWeightedClusters() == nil {
+		t.Error("Got nil weighted clusters")
+	}
+}
+
+func TestCanaryFromAnnotations_MatchOrder(t *testing.T) {
+	annotations := map[string]string{
+		GatewayPrimary:      "app-primary.test",
+		GatewayCanary:       "app-canary.test",
+		GatewayCanaryWeight: "10",
+		GatewayCanaryMatch:  `[{"name":"x-canary","exact":"insider"},{"name":"user-agent","regex":".*Firefox.*"}]`,
+		GatewayCanaryCookie: "canary",
+	}
+
+	first, _ := CanaryFromAnnotations(annotations)
+	firstHash, err := hashstructure.Hash(first, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := 0; i < 50; i++ {
+		canary, _ := CanaryFromAnnotations(annotations)
+		hash, err := hashstructure.Hash(canary, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if hash != firstHash {
+			t.Fatalf("Got checksum %v wanted %v for the same annotations", hash, firstHash)
+		}
+		if name := canary.Match[len(canary.Match)-1].Name; name != "cookie" {
+			t.Fatalf("Got last match %v wanted %v", name, "cookie")
+		}
+	}
+}
+
+func TestNewVirtualHost_CanaryMirror(t *testing.T) {
+	_, upstream := mockUpstream(0, "/")
+	upstream.Canary, _ = CanaryFromAnnotations(map[string]string{
+		GatewayPrimary:      upstream.Canary.PrimaryCluster,
+		GatewayCanary:       upstream.Canary.CanaryCluster,
+		GatewayCanaryWeight: "20",
+		GatewayCanaryMirror: "true",
+	})
+
+	vh := newVirtualHost(upstream)
+	if len(vh.Routes) != 1 {
+		t.Fatalf("Got routes %v wanted %v", len(vh.Routes), 1)
+	}
+
+	action := vh.Routes[0].GetRoute()
+	if cluster := action.GetCluster(); cluster != upstream.Canary.PrimaryCluster {
+		t.Errorf("Got cluster %v wanted %v", cluster, upstream.Canary.PrimaryCluster)
+	}
+
+	if len(action.GetRequestMirrorPolicies()) != 1 {
+		t.Fatalf("Got mirror policies %v wanted %v", len(action.GetRequestMirrorPolicies()), 1)
+	}
+
+	mirror := action.GetRequestMirrorPolicies()[0]
+	if mirror.GetCluster() != upstream.Canary.CanaryCluster {
+		t.Errorf("Got mirror cluster %v wanted %v", mirror.GetCluster(), upstream.Canary.CanaryCluster)
+	}
+	if n := mirror.GetRuntimeFraction().GetDefaultValue().GetNumerator(); n != 20 {
+		t.Errorf("Got mirror percentage %v wanted %v", n, 20)
+	}
+}
@@ -0,0 +1,76 @@
+package events
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+const component = "flagger-appmesh-gateway"
+
+// Recorder records Kubernetes events for the gateway deployment
+type Recorder struct {
+	recorder record.EventRecorder
+	gateway  *corev1.ObjectReference
+}
+
+// NewRecorder creates a Kubernetes event recorder,
+// the gateway deployment UID is looked up so that the events show up in kubectl describe
+func NewRecorder(cfg *rest.Config, client dynamic.Interface, gatewayName string, gatewayNamespace string) (*Recorder, error) {
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+
+	gateway := &corev1.ObjectReference{
+		Kind:       "Deployment",
+		APIVersion: "apps/v1",
+		Name:       gatewayName,
+		Namespace:  gatewayNamespace,
+	}
+
+	deployments := client.Resource(schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"})
+	if deployment, err := deployments.Namespace(gatewayNamespace).Get(gatewayName, metav1.GetOptions{}); err == nil {
+		gateway.UID = deployment.GetUID()
+	} else {
+		klog.Warningf("gateway deployment %s.%s lookup failed %v", gatewayName, gatewayNamespace, err)
+	}
+
+	return NewEventRecorder(broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component}), gateway), nil
+}
+
+// NewEventRecorder wraps an event recorder e.g. a fake recorder in tests,
+// the gateway events are recorded for the referenced object
+func NewEventRecorder(recorder record.EventRecorder, gateway *corev1.ObjectReference) *Recorder {
+	return &Recorder{
+		recorder: recorder,
+		gateway:  gateway,
+	}
+}
+
+// Eventf records an event for a Kubernetes object
+func (r *Recorder) Eventf(obj runtime.Object, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(obj, eventType, reason, messageFmt, args...)
+}
+
+// GatewayEventf records an event for the gateway deployment
+func (r *Recorder) GatewayEventf(eventType string, reason string, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(r.gateway, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var (
+	// XDSStreams counts the connected Envoy streams by type URL
+	XDSStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "appmesh_gateway_xds_streams",
+		Help: "Number of connected Envoy xDS streams by type URL.",
+	}, []string{"type_url"})
+
+	// XDSNacks counts the configuration rejected by Envoy by type URL
+	XDSNacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "appmesh_gateway_xds_nacks_total",
+		Help: "Total number of xDS responses rejected by Envoy by type URL.",
+	}, []string{"type_url"})
+
+	// XDSNackedNodes is the number of Envoy nodes whose last response of a type URL was rejected
+	XDSNackedNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "appmesh_gateway_xds_nacked_nodes",
+		Help: "Number of Envoy nodes running with rejected configuration by type URL.",
+	}, []string{"type_url"})
+
+	// SnapshotVersion is the version of the last Envoy cache snapshot
+	SnapshotVersion = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "appmesh_gateway_snapshot_version",
+		Help: "Version of the last Envoy cache snapshot.",
+	})
+
+	// SnapshotDuration measures the time it takes to build and set the snapshots of all node groups
+	SnapshotDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "appmesh_gateway_snapshot_duration_seconds",
+		Help:    "Seconds spent building the Envoy cache snapshots.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// Upstreams is the number of upstreams in the in-memory cache
+	Upstreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "appmesh_gateway_upstreams",
+		Help: "Number of upstreams in the Envoy cache.",
+	})
+
+	// RejectedUpstreams is the number of upstreams excluded from the snapshots after an Envoy NACK
+	RejectedUpstreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "appmesh_gateway_rejected_upstreams",
+		Help: "Number of upstreams rejected by Envoy and served with their last accepted version.",
+	})
+
+	// DomainConflicts is the number of domains dropped from upstreams because an older upstream claimed them
+	DomainConflicts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "appmesh_gateway_domain_conflicts",
+		Help: "Number of domains dropped from virtual services because they are claimed by an older virtual service.",
+	})
+
+	// Leader is set to one when this replica writes the gateway virtual node
+	Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "appmesh_gateway_leader",
+		Help: "Set to 1 when this replica is the leader that reconciles the gateway virtual node.",
+	})
+
+	// QueueDepth is the number of virtual services waiting to be processed
+	QueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "appmesh_gateway_workqueue_depth",
+		Help: "Number of virtual services waiting in the discovery workqueue.",
+	})
+
+	// QueueRetries counts the discovery workqueue retries
+	QueueRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "appmesh_gateway_workqueue_retries_total",
+		Help: "Total number of retries handled by the discovery workqueue.",
+	})
+
+	// VirtualNodeErrors counts the gateway virtual node reconcile errors
+	VirtualNodeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "appmesh_gateway_virtualnode_reconcile_errors_total",
+		Help: "Total number of gateway virtual node reconcile errors.",
+	})
+)
+
+func init() {
+	// the provider must be set before the named workqueues are created
+	workqueue.SetProvider(workqueueProvider{})
+
+	prometheus.MustRegister(
+		XDSStreams,
+		XDSNacks,
+		XDSNackedNodes,
+		SnapshotVersion,
+		SnapshotDuration,
+		Upstreams,
+		RejectedUpstreams,
+		DomainConflicts,
+		Leader,
+		QueueDepth,
+		QueueRetries,
+		VirtualNodeErrors,
+	)
+}
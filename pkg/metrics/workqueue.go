@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"k8s.io/client-go/util/workqueue"
+)
+
+// workqueueProvider updates the discovery workqueue depth on every add and get,
+// so that the depth keeps growing when the workers are stuck
+type workqueueProvider struct{}
+
+type noopMetric struct{}
+
+func (noopMetric) Inc()            {}
+func (noopMetric) Dec()            {}
+func (noopMetric) Set(float64)     {}
+func (noopMetric) Observe(float64) {}
+
+func (workqueueProvider) NewDepthMetric(string) workqueue.GaugeMetric {
+	return QueueDepth
+}
+
+func (workqueueProvider) NewRetriesMetric(string) workqueue.CounterMetric {
+	return QueueRetries
+}
+
+func (workqueueProvider) NewAddsMetric(string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewLatencyMetric(string) workqueue.HistogramMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewWorkDurationMetric(string) workqueue.HistogramMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewUnfinishedWorkSecondsMetric(string) workqueue.SettableGaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewLongestRunningProcessorSecondsMetric(string) workqueue.SettableGaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedDepthMetric(string) workqueue.GaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedAddsMetric(string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedLatencyMetric(string) workqueue.SummaryMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedWorkDurationMetric(string) workqueue.SummaryMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedUnfinishedWorkSecondsMetric(string) workqueue.SettableGaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedLongestRunningProcessorMicrosecondsMetric(string) workqueue.SettableGaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedRetriesMetric(string) workqueue.CounterMetric {
+	return noopMetric{}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"k8s.io/klog"
+)
+
+// Auth verifies the identity of the Envoy nodes connecting to the xDS server,
+// when TLS is enabled the nodes must present a certificate signed by the CA,
+// when the allowlist is set only the listed node IDs or clusters are served
+type Auth struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	allowed  map[string]bool
+
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+	mu      sync.Mutex
+}
+
+// NewAuth creates an xDS authenticator, TLS is enabled when the certificate files are set,
+// the files are reloaded when they change on disk
+func NewAuth(certFile string, keyFile string, caFile string, allowed []string) (*Auth, error) {
+	auth := &Auth{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		allowed:  make(map[string]bool),
+	}
+
+	for _, name := range allowed {
+		auth.allowed[name] = true
+	}
+
+	if !auth.TLS() {
+		if certFile != "" || keyFile != "" || caFile != "" {
+			return nil, fmt.Errorf("xDS TLS requires the certificate, key and CA files")
+		}
+		return auth, nil
+	}
+
+	if _, _, err := auth.load(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// TLS returns true if the xDS server requires client certificates
+func (a *Auth) TLS() bool {
+	return a != nil && a.certFile != "" && a.keyFile != "" && a.caFile != ""
+}
+
+// Credentials returns the gRPC transport credentials with client certificate verification
+func (a *Auth) Credentials() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool, err := a.load()
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				MinVersion:   tls.VersionTLS12,
+				// gRPC clients such as Envoy negotiate HTTP/2 with ALPN
+				NextProtos: []string{"h2"},
+			}, nil
+		},
+	})
+}
+
+// load returns the certificate and CA pool, the files are read again
+// if any of them was modified since the last load
+func (a *Auth) load() (*tls.Certificate, *x509.CertPool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var modTime time.Time
+	for _, file := range []string{a.certFile, a.keyFile, a.caFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("xDS TLS file %s error %v", file, err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	if a.cert != nil && !modTime.After(a.modTime) {
+		return a.cert, a.pool, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(a.certFile, a.keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("xDS TLS key pair loading failed %v", err)
+	}
+
+	ca, err := ioutil.ReadFile(a.caFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("xDS TLS CA loading failed %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, nil, fmt.Errorf("xDS TLS CA file %s has no certificates", a.caFile)
+	}
+
+	if a.cert != nil {
+		klog.Info("xDS TLS certificates reloaded")
+	}
+	a.cert, a.pool, a.modTime = &cert, pool, modTime
+	return a.cert, a.pool, nil
+}
+
+// Identities returns the common name and DNS names of the client certificate of a stream,
+// it returns an error if TLS is enabled and the certificate identities are not allowed
+func (a *Auth) Identities(ctx context.Context) ([]string, error) {
+	if !a.TLS() {
+		return nil, nil
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("peer not found")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, fmt.Errorf("peer %s has no verified certificate", p.Addr)
+	}
+
+	cert := info.State.VerifiedChains[0][0]
+	identities := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+
+	if len(a.allowed) > 0 {
+		for _, identity := range identities {
+			if a.allowed[identity] {
+				return identities, nil
+			}
+		}
+		return nil, fmt.Errorf("peer %s certificate %v is not allowed", p.Addr, identities)
+	}
+	return identities, nil
+}
+
+// Authorize checks that a node is in the allowlist, with TLS enabled
+// the node ID or cluster must match the certificate identities of its stream
+func (a *Auth) Authorize(node *envoycore.Node, identities []string) error {
+	if a == nil {
+		return nil
+	}
+
+	if len(a.allowed) > 0 && !a.allowed[node.Id] && !a.allowed[node.Cluster] {
+		return fmt.Errorf("node %s cluster %s is not allowed", node.Id, node.Cluster)
+	}
+
+	if a.TLS() {
+		for _, identity := range identities {
+			if identity != "" && (identity == node.Id || identity == node.Cluster) {
+				return nil
+			}
+		}
+		return fmt.Errorf("node %s cluster %s doesn't match certificate %v", node.Id, node.Cluster, identities)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/grpc/peer"
+)
+
+type mockCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func mockCertificate(t *testing.T, name string, ca *mockCert) *mockCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return &mockCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *mockCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *mockCert) keyPair(t *testing.T) tls.Certificate {
+	pair, err := tls.X509KeyPair(c.pem, c.keyPEM(t))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return pair
+}
+
+func writeFile(t *testing.T, file string, data []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// handshake connects a client with the given certificate to the xDS credentials
+// and returns the stream context of the server and the protocol negotiated by the client
+func handshake(t *testing.T, auth *Auth, ca *mockCert, client *mockCert) (context.Context, string) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	tlsClient := tls.Client(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{client.keyPair(t)},
+		RootCAs:      pool,
+		ServerName:   "gateway",
+		NextProtos:   []string{"h2"},
+	})
+
+	protocol := make(chan string, 1)
+	go func() {
+		if err := tlsClient.Handshake(); err != nil {
+			protocol <- ""
+			return
+		}
+		protocol <- tlsClient.ConnectionState().NegotiatedProtocol
+	}()
+
+	_, info, err := auth.Credentials().ServerHandshake(serverConn)
+	if err != nil {
+		t.Fatalf("Got handshake error %v", err)
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: serverConn.RemoteAddr(), AuthInfo: info})
+	return ctx, <-protocol
+}
+
+func TestAuth_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ca := mockCertificate(t, "ca", nil)
+	server := mockCertificate(t, "gateway", ca)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	modTime := time.Now().Add(-time.Minute)
+	writeFile(t, certFile, server.pem, modTime)
+	writeFile(t, keyFile, server.keyPEM(t), modTime)
+	writeFile(t, caFile, ca.pem, modTime)
+
+	auth, err := NewAuth(certFile, keyFile, caFile, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// test that HTTP/2 is negotiated
+	ctx, protocol := handshake(t, auth, ca, mockCertificate(t, "envoy", ca))
+	if protocol != "h2" {
+		t.Errorf("Got protocol %v wanted %v", protocol, "h2")
+	}
+
+	// test certificate identities against the node ID
+	identities, err := auth.Identities(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(identities) != 2 || identities[0] != "envoy" {
+		t.Errorf("Got identities %v wanted %v", identities, []string{"envoy", "envoy"})
+	}
+	if err := auth.Authorize(&envoycore.Node{Id: "envoy"}, identities); err != nil {
+		t.Errorf("Got error %v wanted node %v authorized", err, "envoy")
+	}
+	if err := auth.Authorize(&envoycore.Node{Id: "other", Cluster: "other"}, identities); err == nil {
+		t.Errorf("Got node %v authorized with certificate %v", "other", identities)
+	}
+
+	// test that the certificates are reloaded when the files change
+	reloaded := mockCertificate(t, "gateway", ca)
+	modTime = time.Now()
+	writeFile(t, certFile, reloaded.pem, modTime)
+	writeFile(t, keyFile, reloaded.keyPEM(t), modTime)
+
+	cert, _, err := auth.load()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if leaf.SerialNumber.Cmp(reloaded.cert.SerialNumber) != 0 {
+		t.Errorf("Got certificate serial %v wanted %v", leaf.SerialNumber, reloaded.cert.SerialNumber)
+	}
+}
@@ -2,58 +2,404 @@ package server
 
 import (
 	"context"
+	"sort"
 	"sync"
 
-	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/klog"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/events"
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/metrics"
 )
 
 type callbacks struct {
-	signal   chan struct{}
 	fetches  int
 	requests int
+	snapshot *envoy.Snapshot
+	hasher   envoy.Hasher
+	recorder *events.Recorder
+	auth     *Auth
+	streams  map[int64]*streamState
+	nodes    map[string]*NodeStatus
 	mu       sync.Mutex
 }
 
+// streamState holds the node and the type URLs of an xDS stream
+// and the last response sent for each type URL
+type streamState struct {
+	node       string
+	identities []string
+	typeURLs   map[string]bool
+	responses  map[string]response
+}
+
+type response struct {
+	nonce   string
+	version string
+	acked   bool
+}
+
+// NodeStatus is the xDS state of a connected Envoy node,
+// the versions and errors are the last acked version and the last NACK error of each type URL
+type NodeStatus struct {
+	ID       string            `json:"id"`
+	Group    string            `json:"group"`
+	Version  string            `json:"version"`
+	Versions map[string]string `json:"versions"`
+	Errors   map[string]string `json:"errors,omitempty"`
+	streams  int
+}
+
 func (cb *callbacks) Report() {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	klog.V(4).Infof("report requests %v", cb.requests)
 }
 
-func (cb *callbacks) OnStreamOpen(_ context.Context, id int64, typ string) error {
+func (cb *callbacks) OnStreamOpen(ctx context.Context, id int64, typ string) error {
 	klog.V(4).Infof("stream %d open for %s", id, typ)
-	return nil
+	return cb.openStream(ctx, id)
 }
 
 func (cb *callbacks) OnStreamClosed(id int64) {
 	klog.V(4).Infof("stream %d closed", id)
+	cb.closeStream(id)
 }
 
-func (cb *callbacks) OnStreamRequest(int64, *v2.DiscoveryRequest) error {
+func (cb *callbacks) OnStreamRequest(id int64, req *discovery.DiscoveryRequest) error {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	cb.requests++
-	if cb.signal != nil {
-		close(cb.signal)
-		cb.signal = nil
+	if err := cb.trackStream(id, req.TypeUrl, req.Node); err != nil {
+		return err
+	}
+	if req.ErrorDetail != nil {
+		cb.nack(id, req.TypeUrl, req.ResponseNonce, req.ErrorDetail.Message)
+	} else if req.ResponseNonce != "" {
+		cb.ack(id, req.TypeUrl, req.ResponseNonce, req.VersionInfo)
 	}
+	cb.push(req)
 	return nil
 }
 
-func (cb *callbacks) OnStreamResponse(int64, *v2.DiscoveryRequest, *v2.DiscoveryResponse) {
+func (cb *callbacks) OnStreamResponse(_ context.Context, id int64, _ *discovery.DiscoveryRequest, resp *discovery.DiscoveryResponse) {
+	cb.trackResponse(id, resp.TypeUrl, resp.Nonce, resp.VersionInfo)
 	cb.Report()
 }
 
-func (cb *callbacks) OnFetchRequest(_ context.Context, req *v2.DiscoveryRequest) error {
+func (cb *callbacks) OnDeltaStreamOpen(ctx context.Context, id int64, typ string) error {
+	klog.V(4).Infof("delta stream %d open for %s", id, typ)
+	return cb.openStream(ctx, id)
+}
+
+func (cb *callbacks) OnDeltaStreamClosed(id int64) {
+	klog.V(4).Infof("delta stream %d closed", id)
+	cb.closeStream(id)
+}
+
+func (cb *callbacks) OnStreamDeltaRequest(id int64, req *discovery.DeltaDiscoveryRequest) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.requests++
+	if err := cb.trackStream(id, req.TypeUrl, req.Node); err != nil {
+		return err
+	}
+	if req.ErrorDetail != nil {
+		cb.nack(id, req.TypeUrl, req.ResponseNonce, req.ErrorDetail.Message)
+	} else if req.ResponseNonce != "" {
+		cb.ack(id, req.TypeUrl, req.ResponseNonce, "")
+	}
+	if cb.snapshot != nil && req.Node != nil {
+		cb.pushNode(req.Node)
+	}
+	return nil
+}
+
+func (cb *callbacks) OnStreamDeltaResponse(id int64, _ *discovery.DeltaDiscoveryRequest, resp *discovery.DeltaDiscoveryResponse) {
+	cb.trackResponse(id, resp.TypeUrl, resp.Nonce, resp.SystemVersionInfo)
+	cb.Report()
+}
+
+func (cb *callbacks) OnFetchRequest(ctx context.Context, req *discovery.DiscoveryRequest) error {
+	identities, err := cb.auth.Identities(ctx)
+	if err != nil {
+		klog.Errorf("fetch rejected %v", err)
+		return err
+	}
+	if req.Node != nil {
+		if err := cb.auth.Authorize(req.Node, identities); err != nil {
+			klog.Errorf("fetch rejected %v", err)
+			return err
+		}
+	}
+
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	cb.fetches++
-	if cb.signal != nil {
-		close(cb.signal)
-		cb.signal = nil
+	cb.push(req)
+	return nil
+}
+
+func (cb *callbacks) OnFetchResponse(*discovery.DiscoveryRequest, *discovery.DiscoveryResponse) {}
+
+// openStream rejects the streams of unauthorized peers
+// and records the certificate identities of the authorized ones
+func (cb *callbacks) openStream(ctx context.Context, id int64) error {
+	identities, err := cb.auth.Identities(ctx)
+	if err != nil {
+		klog.Errorf("stream %d rejected %v", id, err)
+		return err
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.stream(id).identities = identities
+	return nil
+}
+
+func (cb *callbacks) stream(id int64) *streamState {
+	if cb.streams == nil {
+		cb.streams = make(map[int64]*streamState)
+		cb.nodes = make(map[string]*NodeStatus)
+	}
+	st, ok := cb.streams[id]
+	if !ok {
+		st = &streamState{
+			typeURLs:  make(map[string]bool),
+			responses: make(map[string]response),
+		}
+		cb.streams[id] = st
+	}
+	return st
+}
+
+// trackStream records the node and the type URLs requested on a stream,
+// an ADS stream is counted once for each type URL it carries,
+// Envoy sets the node only in the first request of a stream
+// and the stream is closed if the node is not authorized
+func (cb *callbacks) trackStream(id int64, typeURL string, node *envoycore.Node) error {
+	st := cb.stream(id)
+	if st.node == "" && node != nil {
+		if err := cb.auth.Authorize(node, st.identities); err != nil {
+			klog.Errorf("stream %d rejected %v", id, err)
+			return err
+		}
+	}
+	if !st.typeURLs[typeURL] {
+		st.typeURLs[typeURL] = true
+		metrics.XDSStreams.WithLabelValues(typeURL).Inc()
+	}
+	if st.node == "" && node != nil && node.Id != "" {
+		st.node = node.Id
+		status, ok := cb.nodes[node.Id]
+		if !ok {
+			status = &NodeStatus{
+				ID:       node.Id,
+				Group:    cb.hasher.ID(node),
+				Versions: make(map[string]string),
+				Errors:   make(map[string]string),
+			}
+			cb.nodes[node.Id] = status
+		}
+		status.streams++
 	}
 	return nil
 }
 
-func (cb *callbacks) OnFetchResponse(*v2.DiscoveryRequest, *v2.DiscoveryResponse) {}
+// trackResponse records the version sent to a stream until Envoy acks or nacks it
+func (cb *callbacks) trackResponse(id int64, typeURL string, nonce string, version string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if st, ok := cb.streams[id]; ok {
+		st.responses[typeURL] = response{nonce: nonce, version: version}
+	}
+}
+
+// ack sets the node version to the version acked on a stream,
+// delta requests don't carry a version so it's looked up by nonce
+func (cb *callbacks) ack(id int64, typeURL string, nonce string, version string) {
+	st, ok := cb.streams[id]
+	if !ok {
+		return
+	}
+	if sent, ok := st.responses[typeURL]; ok && sent.nonce == nonce {
+		if version == "" {
+			version = sent.version
+		}
+		sent.acked = true
+		st.responses[typeURL] = sent
+	}
+	status, ok := cb.nodes[st.node]
+	if !ok || version == "" {
+		return
+	}
+	status.Version = version
+	status.Versions[typeURL] = version
+	if _, ok := status.Errors[typeURL]; ok {
+		delete(status.Errors, typeURL)
+		metrics.XDSNackedNodes.WithLabelValues(typeURL).Dec()
+		klog.Infof("node %s accepted %s version %s", st.node, typeURL, version)
+	}
+
+	if cb.snapshot != nil && cb.acked(status, version) {
+		go func(group string) {
+			if err := cb.snapshot.Accept(group, version); err != nil {
+				klog.Errorf("snapshot error %v", err)
+			}
+		}(status.Group)
+	}
+}
+
+// acked checks if a node has acked all the resource types that changed in a version
+// and all the responses sent for it, in ADS the clusters are acked
+// before the listeners and routes of the same version are sent
+func (cb *callbacks) acked(status *NodeStatus, version string) bool {
+	types, ok := cb.snapshot.ChangedTypes(status.Group, version)
+	if !ok {
+		return false
+	}
+	for _, typeURL := range types {
+		if status.Versions[typeURL] != version {
+			return false
+		}
+	}
+
+	for _, st := range cb.streams {
+		if st.node != status.ID {
+			continue
+		}
+		for _, sent := range st.responses {
+			if sent.version == version && !sent.acked {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// clustersAcked checks if a node has acked the clusters of a version or if the clusters themselves
+// were rejected, the routes and listeners can be rejected for referencing clusters not received yet
+func (cb *callbacks) clustersAcked(status *NodeStatus, typeURL string, version string) bool {
+	if typeURL == resource.ClusterType || status.Versions[resource.ClusterType] == version {
+		return true
+	}
+	types, ok := cb.snapshot.ChangedTypes(status.Group, version)
+	if !ok {
+		return false
+	}
+	for _, t := range types {
+		if t == resource.ClusterType {
+			return false
+		}
+	}
+	return true
+}
+
+// nack records the error of a rejected version, logs it and emits an event for the gateway
+func (cb *callbacks) nack(id int64, typeURL string, nonce string, message string) {
+	st, ok := cb.streams[id]
+	if !ok {
+		return
+	}
+	var version string
+	if sent, ok := st.responses[typeURL]; ok && sent.nonce == nonce {
+		version = sent.version
+	}
+
+	metrics.XDSNacks.WithLabelValues(typeURL).Inc()
+	klog.Errorf("node %s rejected %s version %s %s", st.node, typeURL, version, message)
+	cb.recorder.GatewayEventf(corev1.EventTypeWarning, "RejectedConfig",
+		"Envoy node %s rejected %s version %s %s", st.node, typeURL, version, message)
+
+	if status, ok := cb.nodes[st.node]; ok {
+		if _, ok := status.Errors[typeURL]; !ok {
+			metrics.XDSNackedNodes.WithLabelValues(typeURL).Inc()
+		}
+		status.Errors[typeURL] = message
+
+		if cb.snapshot != nil && version != "" {
+			clustersAcked := cb.clustersAcked(status, typeURL, version)
+			go func(group string) {
+				if err := cb.snapshot.Reject(group, version, message, clustersAcked); err != nil {
+					klog.Errorf("snapshot error %v", err)
+				}
+			}(status.Group)
+		}
+	}
+}
+
+func (cb *callbacks) closeStream(id int64) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	st, ok := cb.streams[id]
+	if !ok {
+		return
+	}
+	for typeURL := range st.typeURLs {
+		metrics.XDSStreams.WithLabelValues(typeURL).Dec()
+	}
+	if status, ok := cb.nodes[st.node]; ok {
+		status.streams--
+		if status.streams < 1 {
+			for typeURL := range status.Errors {
+				metrics.XDSNackedNodes.WithLabelValues(typeURL).Dec()
+			}
+			delete(cb.nodes, st.node)
+			if cb.snapshot != nil && !cb.connected(status.Group) {
+				cb.snapshot.Clear(status.Group)
+			}
+		}
+	}
+	delete(cb.streams, id)
+}
+
+// connected checks if a node group has connected nodes
+func (cb *callbacks) connected(group string) bool {
+	for _, status := range cb.nodes {
+		if status.Group == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Nodes returns the status of the connected Envoy nodes sorted by ID
+func (cb *callbacks) Nodes() []NodeStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	nodes := make([]NodeStatus, 0, len(cb.nodes))
+	for _, status := range cb.nodes {
+		node := *status
+		node.Versions = make(map[string]string)
+		for k, v := range status.Versions {
+			node.Versions[k] = v
+		}
+		node.Errors = make(map[string]string)
+		for k, v := range status.Errors {
+			node.Errors[k] = v
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
+
+// push sets the current snapshot for nodes that connected after the last sync
+func (cb *callbacks) push(req *discovery.DiscoveryRequest) {
+	if cb.snapshot == nil || req.Node == nil {
+		return
+	}
+	cb.pushNode(req.Node)
+}
+
+func (cb *callbacks) pushNode(node *envoycore.Node) {
+	if err := cb.snapshot.Push(cb.hasher.ID(node)); err != nil {
+		klog.Errorf("snapshot error %v", err)
+	}
+}
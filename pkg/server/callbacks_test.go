@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+)
+
+func TestCallbacks_AckNack(t *testing.T) {
+	cb := &callbacks{hasher: envoy.Hasher{}}
+	nodeId := "test"
+
+	// test ack
+	cb.OnStreamRequest(1, &discovery.DiscoveryRequest{
+		Node:    &envoycore.Node{Id: nodeId},
+		TypeUrl: resource.ListenerType,
+	})
+	cb.OnStreamResponse(context.Background(), 1, nil, &discovery.DiscoveryResponse{
+		TypeUrl:     resource.ListenerType,
+		VersionInfo: "1",
+		Nonce:       "1",
+	})
+	cb.OnStreamRequest(1, &discovery.DiscoveryRequest{
+		TypeUrl:       resource.ListenerType,
+		VersionInfo:   "1",
+		ResponseNonce: "1",
+	})
+
+	nodes := cb.Nodes()
+	if len(nodes) != 1 {
+		t.Fatalf("Got nodes %v wanted %v", len(nodes), 1)
+	}
+
+	if nodes[0].Versions[resource.ListenerType] != "1" {
+		t.Errorf("Got version %v wanted %v", nodes[0].Versions[resource.ListenerType], "1")
+	}
+
+	// test nack
+	cb.OnStreamResponse(context.Background(), 1, nil, &discovery.DiscoveryResponse{
+		TypeUrl:     resource.ListenerType,
+		VersionInfo: "2",
+		Nonce:       "2",
+	})
+	cb.OnStreamRequest(1, &discovery.DiscoveryRequest{
+		TypeUrl:       resource.ListenerType,
+		VersionInfo:   "1",
+		ResponseNonce: "2",
+		ErrorDetail:   &status.Status{Message: "invalid listener"},
+	})
+
+	nodes = cb.Nodes()
+	if nodes[0].Versions[resource.ListenerType] != "1" {
+		t.Errorf("Got version %v wanted %v", nodes[0].Versions[resource.ListenerType], "1")
+	}
+
+	if nodes[0].Errors[resource.ListenerType] != "invalid listener" {
+		t.Errorf("Got error %v wanted %v", nodes[0].Errors[resource.ListenerType], "invalid listener")
+	}
+
+	// test delta ack after nack
+	cb.OnStreamDeltaRequest(2, &discovery.DeltaDiscoveryRequest{
+		Node:    &envoycore.Node{Id: nodeId},
+		TypeUrl: resource.ListenerType,
+	})
+	cb.OnStreamDeltaResponse(2, nil, &discovery.DeltaDiscoveryResponse{
+		TypeUrl:           resource.ListenerType,
+		SystemVersionInfo: "3",
+		Nonce:             "3",
+	})
+	cb.OnStreamDeltaRequest(2, &discovery.DeltaDiscoveryRequest{
+		TypeUrl:       resource.ListenerType,
+		ResponseNonce: "3",
+	})
+
+	nodes = cb.Nodes()
+	if nodes[0].Versions[resource.ListenerType] != "3" {
+		t.Errorf("Got version %v wanted %v", nodes[0].Versions[resource.ListenerType], "3")
+	}
+
+	if len(nodes[0].Errors) != 0 {
+		t.Errorf("Got errors %v wanted %v", len(nodes[0].Errors), 0)
+	}
+
+	// test disconnect
+	cb.OnStreamClosed(1)
+	cb.OnDeltaStreamClosed(2)
+	if len(cb.Nodes()) != 0 {
+		t.Errorf("Got nodes %v wanted %v", len(cb.Nodes()), 0)
+	}
+}
+
+func TestCallbacks_Authorize(t *testing.T) {
+	auth, err := NewAuth("", "", "", []string{"gateway"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cb := &callbacks{hasher: envoy.Hasher{}, auth: auth}
+
+	// test allowed cluster
+	err = cb.OnStreamRequest(1, &discovery.DiscoveryRequest{
+		Node:    &envoycore.Node{Id: "envoy-1", Cluster: "gateway"},
+		TypeUrl: resource.ListenerType,
+	})
+	if err != nil {
+		t.Errorf("Got error %v wanted none", err)
+	}
+
+	// test unknown node
+	err = cb.OnStreamRequest(2, &discovery.DiscoveryRequest{
+		Node:    &envoycore.Node{Id: "envoy-2", Cluster: "default"},
+		TypeUrl: resource.ListenerType,
+	})
+	if err == nil {
+		t.Errorf("Got no error wanted node not allowed")
+	}
+
+	if len(cb.Nodes()) != 1 {
+		t.Errorf("Got nodes %v wanted %v", len(cb.Nodes()), 1)
+	}
+}
+
+func TestCallbacks_ClearSnapshot(t *testing.T) {
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	snapshot.Store("test/app", envoy.Upstream{Name: "app-test-9898", Host: "app.test", Port: 9898, Domains: []string{"app.test"}})
+	if err := snapshot.Sync(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cb := &callbacks{hasher: envoy.Hasher{}, snapshot: snapshot}
+	nodeId := "test"
+	for _, id := range []int64{1, 2} {
+		cb.OnStreamRequest(id, &discovery.DiscoveryRequest{
+			Node:    &envoycore.Node{Id: nodeId},
+			TypeUrl: resource.ListenerType,
+		})
+	}
+
+	if _, err := snapshot.Cache().GetSnapshot(nodeId); err != nil {
+		t.Fatalf("Got no snapshot for node %s %v", nodeId, err)
+	}
+
+	// test that the snapshot is kept while the node has streams
+	cb.OnStreamClosed(1)
+	if _, err := snapshot.Cache().GetSnapshot(nodeId); err != nil {
+		t.Errorf("Got no snapshot for node %s %v", nodeId, err)
+	}
+
+	cb.OnStreamClosed(2)
+	if _, err := snapshot.Cache().GetSnapshot(nodeId); err == nil {
+		t.Errorf("Got snapshot for disconnected node %s", nodeId)
+	}
+}
+
+func TestCallbacks_AckedAllTypes(t *testing.T) {
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	snapshot.Store("test/app", envoy.Upstream{Name: "app-test-9898", Host: "app.test", Port: 9898, Domains: []string{"app.test"}})
+	if err := snapshot.Sync(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cb := &callbacks{hasher: envoy.Hasher{}, snapshot: snapshot}
+	nodeId := "test"
+	cb.OnStreamRequest(1, &discovery.DiscoveryRequest{
+		Node:    &envoycore.Node{Id: nodeId},
+		TypeUrl: resource.ClusterType,
+	})
+	version, _ := snapshot.Version()
+
+	ack := func(typeURL string, nonce string) {
+		cb.OnStreamResponse(context.Background(), 1, nil, &discovery.DiscoveryResponse{
+			TypeUrl:     typeURL,
+			VersionInfo: version,
+			Nonce:       nonce,
+		})
+		cb.OnStreamRequest(1, &discovery.DiscoveryRequest{
+			TypeUrl:       typeURL,
+			VersionInfo:   version,
+			ResponseNonce: nonce,
+		})
+	}
+
+	// test that a version isn't accepted when only the clusters are acked
+	ack(resource.ClusterType, "1")
+	cb.mu.Lock()
+	acked := cb.acked(cb.nodes[nodeId], version)
+	cb.mu.Unlock()
+	if acked {
+		t.Errorf("Got version %v accepted before the listeners and routes were acked", version)
+	}
+
+	ack(resource.ListenerType, "2")
+	ack(resource.RouteType, "3")
+	cb.mu.Lock()
+	acked = cb.acked(cb.nodes[nodeId], version)
+	cb.mu.Unlock()
+	if !acked {
+		t.Errorf("Got version %v not accepted after all types were acked", version)
+	}
+}
+
+func TestCallbacks_ClustersAcked(t *testing.T) {
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	snapshot.Store("test/app", envoy.Upstream{Name: "app-test-9898", Host: "app.test", Port: 9898, Domains: []string{"app.test"}})
+	if err := snapshot.Sync(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cb := &callbacks{hasher: envoy.Hasher{}, snapshot: snapshot}
+	nodeId := "test"
+	cb.OnStreamRequest(1, &discovery.DiscoveryRequest{
+		Node:    &envoycore.Node{Id: nodeId},
+		TypeUrl: resource.ClusterType,
+	})
+	version, _ := snapshot.Version()
+	status := cb.nodes[nodeId]
+
+	// test that the routes rejected before the clusters are acked are not attributed
+	if cb.clustersAcked(status, resource.RouteType, version) {
+		t.Errorf("Got clusters acked before the node acked version %v", version)
+	}
+	// test that the rejected clusters are always attributed
+	if !cb.clustersAcked(status, resource.ClusterType, version) {
+		t.Errorf("Got rejected clusters not attributed")
+	}
+
+	status.Versions[resource.ClusterType] = version
+	if !cb.clustersAcked(status, resource.RouteType, version) {
+		t.Errorf("Got clusters not acked after the node acked version %v", version)
+	}
+}
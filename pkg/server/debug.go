@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"k8s.io/klog"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+)
+
+// snapshotStatus is the debug view of the Envoy cache,
+// secrets are never rendered since they contain private keys
+type snapshotStatus struct {
+	Version   string                 `json:"version"`
+	Checksum  uint64                 `json:"checksum"`
+	Conflicts []envoy.Conflict       `json:"conflicts,omitempty"`
+	Groups    map[string]groupStatus `json:"groups"`
+}
+
+type groupStatus struct {
+	Version   string            `json:"version"`
+	Clusters  []json.RawMessage `json:"clusters"`
+	Routes    []json.RawMessage `json:"routes"`
+	Listeners []json.RawMessage `json:"listeners"`
+}
+
+// upstreamsHandler returns the upstreams stored in the in-memory cache
+func (srv *HTTPServer) upstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	srv.writeJSON(w, r, srv.snapshot.Upstreams())
+}
+
+// nodesHandler returns the connected Envoy nodes and their last acked version
+func (srv *HTTPServer) nodesHandler(w http.ResponseWriter, r *http.Request) {
+	srv.writeJSON(w, r, srv.xds.Nodes())
+}
+
+// snapshotHandler returns the snapshot version and checksum
+// and the clusters, routes and listeners of each node group as Envoy JSON
+func (srv *HTTPServer) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	version, checksum := srv.snapshot.Version()
+	status := snapshotStatus{
+		Version:   version,
+		Checksum:  checksum,
+		Conflicts: srv.snapshot.Conflicts(),
+		Groups:    make(map[string]groupStatus),
+	}
+
+	cache := srv.snapshot.Cache()
+	for _, group := range cache.GetStatusKeys() {
+		snap, err := cache.GetSnapshot(group)
+		if err != nil {
+			continue
+		}
+
+		var gs groupStatus
+		gs.Version = snap.GetVersion(resource.ListenerType)
+		for typeURL, list := range map[string]*[]json.RawMessage{
+			resource.ClusterType:  &gs.Clusters,
+			resource.RouteType:    &gs.Routes,
+			resource.ListenerType: &gs.Listeners,
+		} {
+			resources := snap.GetResources(typeURL)
+			var names []string
+			for name := range resources {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				b, err := protojson.Marshal(resources[name])
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				*list = append(*list, b)
+			}
+		}
+		status.Groups[group] = gs
+	}
+
+	srv.writeJSON(w, r, status)
+}
+
+func (srv *HTTPServer) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		klog.Errorf("debug response encoding failed %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+)
+
+func mockDebugServer(t *testing.T) *HTTPServer {
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	snapshot.Store("test/app", envoy.Upstream{
+		Name:      "app-test-9898",
+		Host:      "app.test",
+		Port:      9898,
+		Domains:   []string{"app.test"},
+		TLSSecret: "test/app-tls",
+	})
+	snapshot.StoreCertificate("test/app-tls", envoy.Certificate{
+		Name:  "test/app-tls",
+		Chain: []byte("mock-certificate-chain"),
+		Key:   []byte("mock-private-key"),
+	})
+	if err := snapshot.Sync(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req := &discovery.DiscoveryRequest{
+		Node:    &envoycore.Node{Id: "test"},
+		TypeUrl: resource.ListenerType,
+	}
+	xds := NewServer(0, snapshot.Cache(), snapshot, envoy.Hasher{}, nil, nil)
+	xds.cb.OnStreamRequest(1, req)
+	snapshot.Cache().CreateWatch(req, stream.NewStreamState(false, nil), make(chan cache.Response, 1))
+
+	return NewHTTPServer(0, func() error { return nil }, snapshot, xds)
+}
+
+func debugRequest(t *testing.T, srv *HTTPServer, method string, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	srv.mux.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestHTTPServer_DebugUpstreams(t *testing.T) {
+	srv := mockDebugServer(t)
+
+	rec := debugRequest(t, srv, http.MethodGet, "/debug/upstreams")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status %v wanted %v", rec.Code, http.StatusOK)
+	}
+
+	var upstreams map[string]envoy.Upstream
+	if err := json.Unmarshal(rec.Body.Bytes(), &upstreams); err != nil {
+		t.Fatal(err.Error())
+	}
+	if u, ok := upstreams["test/app"]; !ok || u.Name != "app-test-9898" {
+		t.Errorf("Got upstreams %v wanted %v", upstreams, "test/app")
+	}
+}
+
+func TestHTTPServer_DebugSnapshot(t *testing.T) {
+	srv := mockDebugServer(t)
+
+	rec := debugRequest(t, srv, http.MethodGet, "/debug/snapshot")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status %v wanted %v", rec.Code, http.StatusOK)
+	}
+
+	var status snapshotStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err.Error())
+	}
+	if version, _ := srv.snapshot.Version(); status.Version != version || status.Checksum == 0 {
+		t.Errorf("Got version %v checksum %v wanted %v", status.Version, status.Checksum, version)
+	}
+	group, ok := status.Groups["test"]
+	if !ok {
+		t.Fatalf("Got groups %v wanted %v", status.Groups, "test")
+	}
+	if len(group.Clusters) != 1 || len(group.Routes) == 0 || len(group.Listeners) == 0 {
+		t.Errorf("Got clusters %v routes %v listeners %v", len(group.Clusters), len(group.Routes), len(group.Listeners))
+	}
+
+	// test that the secrets are never rendered
+	snap, err := srv.snapshot.Cache().GetSnapshot("test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(snap.GetResources(resource.SecretType)) != 1 {
+		t.Fatalf("Got secrets %v wanted %v", len(snap.GetResources(resource.SecretType)), 1)
+	}
+	body := rec.Body.String()
+	for _, secret := range []string{"mock-private-key", base64.StdEncoding.EncodeToString([]byte("mock-private-key")), "private_key", "privateKey"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("Got secret %q in the snapshot", secret)
+		}
+	}
+}
+
+func TestHTTPServer_DebugNodes(t *testing.T) {
+	srv := mockDebugServer(t)
+
+	rec := debugRequest(t, srv, http.MethodGet, "/debug/nodes")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status %v wanted %v", rec.Code, http.StatusOK)
+	}
+
+	var nodes []NodeStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &nodes); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(nodes) != 1 || nodes[0].ID != "test" || nodes[0].Group != "test" {
+		t.Errorf("Got nodes %v wanted %v", nodes, "test")
+	}
+}
+
+func TestHTTPServer_DebugMethod(t *testing.T) {
+	srv := mockDebugServer(t)
+
+	for _, path := range []string{"/debug/upstreams", "/debug/snapshot", "/debug/nodes"} {
+		for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+			if rec := debugRequest(t, srv, method, path); rec.Code != http.StatusMethodNotAllowed {
+				t.Errorf("Got status %v wanted %v for %s %s", rec.Code, http.StatusMethodNotAllowed, method, path)
+			}
+		}
+	}
+}
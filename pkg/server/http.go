@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+)
+
+// HTTPServer exposes the control plane metrics, health checks and debug API
+type HTTPServer struct {
+	port     int
+	mux      *http.ServeMux
+	ready    func() error
+	snapshot *envoy.Snapshot
+	xds      *Server
+	draining int32
+}
+
+// NewHTTPServer creates an HTTP server with the Prometheus metrics, liveness and readiness endpoints
+// and a read-only debug API, the readiness endpoint fails while the ready function returns an error
+func NewHTTPServer(port int, ready func() error, snapshot *envoy.Snapshot, xds *Server) *HTTPServer {
+	srv := &HTTPServer{
+		port:     port,
+		mux:      http.NewServeMux(),
+		ready:    ready,
+		snapshot: snapshot,
+		xds:      xds,
+	}
+
+	srv.mux.Handle("/metrics", promhttp.Handler())
+	srv.mux.HandleFunc("/healthz", srv.healthzHandler)
+	srv.mux.HandleFunc("/readyz", srv.readyzHandler)
+	srv.mux.HandleFunc("/debug/upstreams", srv.upstreamsHandler)
+	srv.mux.HandleFunc("/debug/snapshot", srv.snapshotHandler)
+	srv.mux.HandleFunc("/debug/nodes", srv.nodesHandler)
+
+	return srv
+}
+
+func (srv *HTTPServer) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// Drain fails the readiness checks so that Kubernetes stops
+// sending traffic to the gateway before it shuts down
+func (srv *HTTPServer) Drain() {
+	atomic.StoreInt32(&srv.draining, 1)
+}
+
+func (srv *HTTPServer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&srv.draining) == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("shutting down"))
+		return
+	}
+	if err := srv.ready(); err != nil {
+		klog.V(4).Infof("readiness check failed %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// ListenAndServe starts the HTTP server and stops it when the context is done
+func (srv *HTTPServer) ListenAndServe(ctx context.Context) {
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%d", srv.port),
+		Handler:      srv.mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			klog.Fatalf("HTTP server failed to listen on %d %v", srv.port, err)
+		}
+	}()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		klog.Errorf("HTTP server shutdown failed %v", err)
+	}
+}
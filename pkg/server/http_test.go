@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPServer_Readyz(t *testing.T) {
+	var readyErr error
+	srv := NewHTTPServer(0, func() error { return readyErr }, nil, nil)
+
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		srv.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+
+	readyErr = fmt.Errorf("snapshot not synced")
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %v wanted %v", code, http.StatusServiceUnavailable)
+	}
+
+	readyErr = nil
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("Got status %v wanted %v", code, http.StatusOK)
+	}
+
+	// test that draining fails the readiness check even if the controller is ready
+	srv.Drain()
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %v wanted %v", code, http.StatusServiceUnavailable)
+	}
+}
@@ -4,48 +4,58 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"time"
 
-	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
-	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
-	"github.com/envoyproxy/go-control-plane/pkg/cache"
-	xds "github.com/envoyproxy/go-control-plane/pkg/server"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	listenerservice "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	secretservice "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 	"google.golang.org/grpc"
 	"k8s.io/klog"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/events"
 )
 
 // Server Envoy management server
 type Server struct {
-	config    cache.SnapshotCache
-	xdsServer xds.Server
-	port      int
-	cb        *callbacks
-	cbSignal  chan struct{}
+	config cache.SnapshotCache
+	port   int
+	cb     *callbacks
 }
 
-// NewServer creates an Envoy xDS management server
-func NewServer(port int, config cache.SnapshotCache) *Server {
-	cbSignal := make(chan struct{})
+// NewServer creates an Envoy xDS v3 management server,
+// nodes that connect after a snapshot sync receive the current snapshot of their group,
+// the configuration rejected by Envoy is recorded as events of the gateway
+// and the streams of unauthorized nodes are rejected
+func NewServer(port int, config cache.SnapshotCache, snapshot *envoy.Snapshot, hasher envoy.Hasher, recorder *events.Recorder, auth *Auth) *Server {
 	cb := &callbacks{
-		signal:   cbSignal,
 		fetches:  0,
 		requests: 0,
+		snapshot: snapshot,
+		hasher:   hasher,
+		recorder: recorder,
+		auth:     auth,
 	}
 
-	xdsServer := xds.NewServer(config, cb)
-
 	return &Server{
-		config:    config,
-		xdsServer: xdsServer,
-		port:      port,
-		cbSignal:  cbSignal,
-		cb:        cb,
+		config: config,
+		port:   port,
+		cb:     cb,
 	}
 }
 
-// Serve starts the Envoy xDS management server
+// Serve starts the Envoy xDS management server and stops it when the context is done
 func (srv *Server) Serve(ctx context.Context) {
 	var options []grpc.ServerOption
 	options = append(options, grpc.MaxConcurrentStreams(1000000))
+	if srv.cb.auth.TLS() {
+		options = append(options, grpc.Creds(srv.cb.auth.Credentials()))
+	}
 	grpcServer := grpc.NewServer(options...)
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", srv.port))
@@ -53,11 +63,13 @@ func (srv *Server) Serve(ctx context.Context) {
 		klog.Fatalf("server failed to listen on %d %v", srv.port, err)
 	}
 
-	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, srv.xdsServer)
-	v2.RegisterEndpointDiscoveryServiceServer(grpcServer, srv.xdsServer)
-	v2.RegisterClusterDiscoveryServiceServer(grpcServer, srv.xdsServer)
-	v2.RegisterRouteDiscoveryServiceServer(grpcServer, srv.xdsServer)
-	v2.RegisterListenerDiscoveryServiceServer(grpcServer, srv.xdsServer)
+	xdsServer := xds.NewServer(ctx, srv.config, srv.cb)
+	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, xdsServer)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(grpcServer, xdsServer)
+	clusterservice.RegisterClusterDiscoveryServiceServer(grpcServer, xdsServer)
+	routeservice.RegisterRouteDiscoveryServiceServer(grpcServer, xdsServer)
+	listenerservice.RegisterListenerDiscoveryServiceServer(grpcServer, xdsServer)
+	secretservice.RegisterSecretDiscoveryServiceServer(grpcServer, xdsServer)
 
 	go func() {
 		if err = grpcServer.Serve(listener); err != nil {
@@ -66,12 +78,22 @@ func (srv *Server) Serve(ctx context.Context) {
 	}()
 	<-ctx.Done()
 
-	grpcServer.GracefulStop()
+	// Envoy keeps its streams open, so the graceful stop is bounded
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		klog.Info("xDS server graceful stop timed out, closing the remaining streams")
+		grpcServer.Stop()
+	}
 }
 
-// Report waits for Envoy to access the xDS server
-// and logs the number of gRPC requests
-func (srv *Server) Report() {
-	<-srv.cbSignal
-	srv.cb.Report()
+// Nodes returns the connected Envoy nodes, their last acked versions and NACK errors
+func (srv *Server) Nodes() []NodeStatus {
+	return srv.cb.Nodes()
 }
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/discovery"
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+)
+
+// WebhookServer is a validating admission webhook that rejects
+// virtual services with invalid gateway annotations or conflicting domains
+type WebhookServer struct {
+	port      int
+	certFile  string
+	keyFile   string
+	mux       *http.ServeMux
+	vsManager *discovery.VirtualServiceManager
+	snapshot  *envoy.Snapshot
+}
+
+// NewWebhookServer creates an HTTPS server that validates the virtual services on /validate,
+// the annotations are parsed the same way as by the discovery controller and
+// the domains are checked against the upstreams of the other exposed virtual services
+func NewWebhookServer(port int, certFile string, keyFile string, vsManager *discovery.VirtualServiceManager, snapshot *envoy.Snapshot) *WebhookServer {
+	srv := &WebhookServer{
+		port:      port,
+		certFile:  certFile,
+		keyFile:   keyFile,
+		mux:       http.NewServeMux(),
+		vsManager: vsManager,
+		snapshot:  snapshot,
+	}
+
+	srv.mux.HandleFunc("/validate", srv.validateHandler)
+
+	return srv
+}
+
+func (srv *WebhookServer) validateHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid admission review %v", err), http.StatusBadRequest)
+		return
+	}
+
+	req := review.Request
+	resp := &admissionv1.AdmissionResponse{
+		UID:     req.UID,
+		Allowed: true,
+	}
+	if err := srv.validate(req.Namespace, req.Object.Raw); err != nil {
+		klog.Infof("virtual service %s/%s rejected %v", req.Namespace, req.Name, err)
+		resp.Allowed = false
+		resp.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: err.Error(),
+			Code:    http.StatusUnprocessableEntity,
+		}
+	}
+
+	// the response has the same API version as the request
+	review.Request = nil
+	review.Response = resp
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		klog.Errorf("webhook response failed %v", err)
+	}
+}
+
+// validate checks the gateway annotations of an eligible virtual service
+// and the domains claimed by older virtual services
+func (srv *WebhookServer) validate(namespace string, raw []byte) error {
+	un := &unstructured.Unstructured{}
+	if err := un.UnmarshalJSON(raw); err != nil {
+		return fmt.Errorf("invalid object %v", err)
+	}
+	if un.GetNamespace() == "" {
+		un.SetNamespace(namespace)
+	}
+	vs, err := srv.vsManager.VirtualServiceFromUnstructured(un)
+	if err != nil {
+		return fmt.Errorf("invalid virtual service %v", err)
+	}
+	if ok, _ := srv.vsManager.IsValid(*vs); !ok {
+		return nil
+	}
+
+	upstream, errs := srv.vsManager.ConvertToUpstream(*vs)
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+
+	// a virtual service being created has no creation timestamp yet
+	if upstream.Created.IsZero() {
+		upstream.Created = time.Now()
+	}
+
+	// the domains are rejected only if the other upstream would win them in the snapshot
+	key := fmt.Sprintf("%s/%s", vs.Namespace, vs.Name)
+	for otherKey, other := range srv.snapshot.Upstreams() {
+		if otherKey == key || !envoy.Precedes(otherKey, other, key, upstream) {
+			continue
+		}
+		for _, domain := range upstream.ConflictingDomains(other) {
+			messages = append(messages, fmt.Sprintf("domain %s is claimed by %s", domain, otherKey))
+		}
+	}
+
+	if len(messages) > 0 {
+		sort.Strings(messages)
+		return fmt.Errorf("%s", strings.Join(messages, ", "))
+	}
+	return nil
+}
+
+// ListenAndServeTLS starts the webhook server and stops it when the context is done
+func (srv *WebhookServer) ListenAndServeTLS(ctx context.Context) {
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%d", srv.port),
+		Handler:      srv.mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.ListenAndServeTLS(srv.certFile, srv.keyFile); err != nil && err != http.ErrServerClosed {
+			klog.Fatalf("webhook server failed to listen on %d %v", srv.port, err)
+		}
+	}()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		klog.Errorf("webhook server shutdown failed %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/discovery"
+	"github.com/stefanprodan/flagger-appmesh-gateway/pkg/envoy"
+)
+
+func mockReview(t *testing.T, name string, created string, annotations string) []byte {
+	timestamp := ""
+	if created != "" {
+		timestamp = fmt.Sprintf(`"creationTimestamp": "%s", `, created)
+	}
+	vs := fmt.Sprintf(`{
+  "apiVersion": "appmesh.k8s.aws/v1beta1",
+  "kind": "VirtualService",
+  "metadata": {"name": "%s", %s"annotations": {%s}},
+  "spec": {"meshName": "appmesh", "virtualRouter": {"name": "%s", "listeners": [{"portMapping": {"port": 9898, "protocol": "http"}}]}}
+}`, name, timestamp, annotations, name)
+
+	review := admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test",
+			Name:      name,
+			Namespace: "test",
+			Object:    runtime.RawExtension{Raw: []byte(vs)},
+		},
+	}
+	review.APIVersion = "admission.k8s.io/v1"
+	review.Kind = "AdmissionReview"
+	b, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return b
+}
+
+func TestWebhookServer_Validate(t *testing.T) {
+	snapshot := envoy.NewSnapshot(envoy.NewCache(true, envoy.Hasher{}))
+	snapshot.Store("test/app1.test", envoy.Upstream{
+		Name:    "app1-test-9898",
+		Host:    "app1.test",
+		Domains: []string{"app1.test", "app1.test:9898", "example.com"},
+	})
+	snapshot.Store("test/app3.test", envoy.Upstream{
+		Name:    "app3-test-9898",
+		Host:    "app3.test",
+		Domains: []string{"app3.test", "app3.test:9898", "api.example.com"},
+		Created: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	})
+	srv := NewWebhookServer(0, "", "", discovery.NewVirtualServiceManager(nil, false, false), snapshot)
+
+	tests := []struct {
+		name        string
+		created     string
+		annotations string
+		allowed     bool
+	}{
+		{"app1.test", "", `"gateway.appmesh.k8s.aws/domain": "example.com"`, true},
+		{"app2.test", "", `"gateway.appmesh.k8s.aws/domain": "www.example.com"`, true},
+		{"app2.test", "", `"gateway.appmesh.k8s.aws/domain": "example.com"`, false},
+		{"app2.test", "", `"gateway.appmesh.k8s.aws/timeout": "10"`, false},
+		{"app2.test", "", `"gateway.appmesh.k8s.aws/expose": "false", "gateway.appmesh.k8s.aws/timeout": "10"`, true},
+		// the older virtual service wins the domain held by a newer one
+		{"app2.test", "2019-01-01T00:00:00Z", `"gateway.appmesh.k8s.aws/domain": "api.example.com"`, true},
+		{"app2.test", "2021-01-01T00:00:00Z", `"gateway.appmesh.k8s.aws/domain": "api.example.com"`, false},
+		// the key decides between virtual services created at the same time
+		{"app2.test", "2020-01-01T00:00:00Z", `"gateway.appmesh.k8s.aws/domain": "api.example.com"`, true},
+		{"app4.test", "2020-01-01T00:00:00Z", `"gateway.appmesh.k8s.aws/domain": "api.example.com"`, false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(mockReview(t, test.name, test.created, test.annotations)))
+		rec := httptest.NewRecorder()
+		srv.mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Got status %v wanted %v", rec.Code, http.StatusOK)
+		}
+
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+			t.Fatal(err.Error())
+		}
+		if review.Response == nil || review.Response.UID != "test" {
+			t.Fatalf("Got response %v wanted UID %v", review.Response, "test")
+		}
+		if review.Response.Allowed != test.allowed {
+			t.Errorf("Got allowed %v wanted %v for %s %s", review.Response.Allowed, test.allowed, test.name, test.annotations)
+		}
+		if review.APIVersion != "admission.k8s.io/v1" {
+			t.Errorf("Got API version %v wanted %v", review.APIVersion, "admission.k8s.io/v1")
+		}
+	}
+}